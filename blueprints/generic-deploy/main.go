@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
 
 	"dagger/generic-deploy/internal/dagger"
 )
@@ -37,11 +40,188 @@ func (m *GenericDeploy) BuildAndPush(
 	// +optional
 	buildArgs []string,
 ) (string, error) {
-	docker := dag.Docker(m.Source, m.InfisicalClientSecret, repoName, dagger.DockerOpts{
+	return buildImage(m.docker(env, repoName), nil, buildArgs).Publish(ctx)
+}
+
+// PublishContainer pushes a container built without a Dockerfile to the container registry
+func (m *GenericDeploy) PublishContainer(
+	ctx context.Context,
+	// The container to publish
+	container *dagger.Container,
+	// Environment to publish image for
+	// +default="staging"
+	env string,
+	repoName string,
+) (string, error) {
+	return buildImage(m.docker(env, repoName), container, nil).Publish(ctx)
+}
+
+// dockerImage is the part of the docker module that prepares the image to publish
+type dockerImage interface {
+	Build(opts ...dagger.DockerBuildOpts) *dagger.Docker
+	BuildContainer(container *dagger.Container) *dagger.Docker
+}
+
+// docker returns the docker module publishing the repository's image for the environment
+func (m *GenericDeploy) docker(env string, repoName string) *dagger.Docker {
+	return dag.Docker(m.Source, m.InfisicalClientSecret, repoName, dagger.DockerOpts{
 		Environment: env,
 	})
+}
+
+// buildImage returns the docker module with the image to publish: the container as-is when given,
+// skipping the Dockerfile build, or otherwise the source's Dockerfile built with the build args
+func buildImage(docker dockerImage, container *dagger.Container, buildArgs []string) *dagger.Docker {
+	if container != nil {
+		return docker.BuildContainer(container)
+	}
 
 	return docker.Build(dagger.DockerBuildOpts{
 		BuildArgs: buildArgs,
-	}).Publish(ctx)
+	})
+}
+
+// DeployResult holds everything produced by a deploy
+type DeployResult struct {
+	// Published image address for the environment tag, including the digest
+	Address string
+	// All published image addresses, including the version tag when a version was given
+	Addresses []string
+	// Image manifest digest
+	Digest string
+	// Environment the image was deployed for
+	Environment string
+	// Version the image was tagged with, if any
+	Version string
+	// Build provenance document
+	Provenance *dagger.File
+}
+
+// Deploy builds and pushes the Docker image, returning the published image and its artifacts
+func (m *GenericDeploy) Deploy(
+	ctx context.Context,
+	// Environment to build image for
+	// +default="staging"
+	env string,
+	repoName string,
+	// Additional build arguments, format KEY=VALUE
+	// +optional
+	buildArgs []string,
+	// Semantic version to additionally tag the image with, e.g. from git-repo's get-next-version
+	// +optional
+	version string,
+) (*DeployResult, error) {
+	docker := buildImage(m.docker(env, repoName), nil, buildArgs)
+
+	var addresses []string
+	if version != "" {
+		var err error
+		addresses, err = docker.PublishVersioned(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		address, err := docker.Publish(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = []string{address}
+	}
+
+	return newDeployResult(env, version, addresses, docker.Provenance())
+}
+
+// newDeployResult returns the result of a deploy that published the addresses, reading the
+// environment tag's address and digest from the last one
+func newDeployResult(env string, version string, addresses []string, provenance *dagger.File) (*DeployResult, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no image addresses were published")
+	}
+
+	// The environment tag is always published last
+	address := addresses[len(addresses)-1]
+	_, digest, ok := strings.Cut(address, "@")
+	if !ok {
+		return nil, fmt.Errorf("published address %s has no digest", address)
+	}
+
+	return &DeployResult{
+		Address:     address,
+		Addresses:   addresses,
+		Digest:      digest,
+		Environment: env,
+		Version:     version,
+		Provenance:  provenance,
+	}, nil
+}
+
+// WithRuntimeSecrets returns the container with the given Infisical secrets set as secret environment
+// variables. Secret variables are only present while the container runs and are never written to
+// image layers or the published image config
+func (m *GenericDeploy) WithRuntimeSecrets(
+	// The container to add the secrets to
+	container *dagger.Container,
+	// Environment to read secrets from
+	// +default="staging"
+	env string,
+	// Secret keys to set
+	keys []string,
+) *dagger.Container {
+	infisical := dag.Infisical(m.InfisicalClientSecret, env)
+
+	for _, key := range keys {
+		container = container.WithSecretVariable(key, infisical.GetSecret(key))
+	}
+
+	return container
+}
+
+// EnvFile resolves the given Infisical secrets into a KEY=VALUE env file for the runtime, returned as
+// a secret so its contents are never logged or cached in plaintext
+func (m *GenericDeploy) EnvFile(
+	ctx context.Context,
+	// Environment to read secrets from
+	// +default="staging"
+	env string,
+	// Secret keys to include
+	keys []string,
+) (*dagger.Secret, error) {
+	infisical := dag.Infisical(m.InfisicalClientSecret, env)
+
+	contents, err := envFileContents(keys, func(key string) (string, error) {
+		return infisical.GetSecret(key).Plaintext(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret(envFileSecretName(env, contents), contents), nil
+}
+
+// envFileContents returns the KEY=VALUE env file of the keys with the values lookup returns
+func envFileContents(keys []string, lookup func(key string) (string, error)) (string, error) {
+	var lines []string
+	for _, key := range keys {
+		value, err := lookup(key)
+		if err != nil {
+			return "", fmt.Errorf("failed to get secret %s: %w", key, err)
+		}
+
+		// Env files have no standard quoting, so multiline values can't be represented
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("secret %s contains a newline and can't be written to an env file", key)
+		}
+
+		lines = append(lines, key+"="+value)
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// envFileSecretName names an env file secret after its contents, so env files with the same keys
+// but different values don't shadow each other
+func envFileSecretName(env string, contents string) string {
+	digest := sha256.Sum256([]byte(contents))
+	return fmt.Sprintf("%s-env-file-%x", env, digest[:6])
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"dagger/generic-deploy/internal/dagger"
+)
+
+func TestNewDeployResult(t *testing.T) {
+	provenance := &dagger.File{}
+	addresses := []string{
+		"docker.io/alice/cloud:web-v1.2.3@sha256:abc123",
+		"docker.io/alice/cloud:web-production@sha256:abc123",
+	}
+
+	got, err := newDeployResult("production", "v1.2.3", addresses, provenance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DeployResult{
+		Address:     "docker.io/alice/cloud:web-production@sha256:abc123",
+		Addresses:   addresses,
+		Digest:      "sha256:abc123",
+		Environment: "production",
+		Version:     "v1.2.3",
+		Provenance:  provenance,
+	}
+
+	if got.Address != want.Address || !slices.Equal(got.Addresses, want.Addresses) || got.Digest != want.Digest ||
+		got.Environment != want.Environment || got.Version != want.Version || got.Provenance != want.Provenance {
+		t.Errorf("newDeployResult() = %+v, want %+v", *got, want)
+	}
+}
+
+func TestNewDeployResultInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+	}{
+		{"nothing published", nil},
+		{"address without a digest", []string{"docker.io/alice/cloud:web-staging"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newDeployResult("staging", "", tt.addresses, nil); err == nil {
+				t.Error("newDeployResult() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// recordingDocker records how the image to publish was prepared
+type recordingDocker struct {
+	builds     []dagger.DockerBuildOpts
+	containers []*dagger.Container
+}
+
+func (d *recordingDocker) Build(opts ...dagger.DockerBuildOpts) *dagger.Docker {
+	d.builds = append(d.builds, opts...)
+	return &dagger.Docker{}
+}
+
+func (d *recordingDocker) BuildContainer(container *dagger.Container) *dagger.Docker {
+	d.containers = append(d.containers, container)
+	return &dagger.Docker{}
+}
+
+func TestBuildImageContainer(t *testing.T) {
+	docker := &recordingDocker{}
+	container := &dagger.Container{}
+
+	buildImage(docker, container, []string{"IGNORED=1"})
+
+	if len(docker.builds) != 0 {
+		t.Errorf("buildImage() ran a Dockerfile build with %+v, want the container published as-is", docker.builds)
+	}
+
+	if len(docker.containers) != 1 || docker.containers[0] != container {
+		t.Errorf("buildImage() used containers %v, want the given container", docker.containers)
+	}
+}
+
+func TestBuildImageDockerfile(t *testing.T) {
+	docker := &recordingDocker{}
+
+	buildImage(docker, nil, []string{"NODE_ENV=production"})
+
+	if len(docker.containers) != 0 {
+		t.Errorf("buildImage() used containers %v, want a Dockerfile build", docker.containers)
+	}
+
+	if len(docker.builds) != 1 || !slices.Equal(docker.builds[0].BuildArgs, []string{"NODE_ENV=production"}) {
+		t.Errorf("buildImage() ran builds %+v, want one with the build args", docker.builds)
+	}
+}
+
+func TestEnvFileContents(t *testing.T) {
+	secrets := map[string]string{"DB_HOST": "db.internal", "DB_PASSWORD": "p@ss=word", "CERT": "line1\nline2"}
+	lookup := func(key string) (string, error) {
+		value, ok := secrets[key]
+		if !ok {
+			return "", fmt.Errorf("secret not found")
+		}
+
+		return value, nil
+	}
+
+	got, err := envFileContents([]string{"DB_HOST", "DB_PASSWORD"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "DB_HOST=db.internal\nDB_PASSWORD=p@ss=word\n"; got != want {
+		t.Errorf("envFileContents() = %q, want %q", got, want)
+	}
+
+	for _, key := range []string{"MISSING", "CERT"} {
+		if _, err := envFileContents([]string{"DB_HOST", key}, lookup); err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("envFileContents() with %s error = %v, want one naming the key", key, err)
+		}
+	}
+}
+
+func TestEnvFileSecretName(t *testing.T) {
+	name := envFileSecretName("staging", "DB_PASSWORD=one\n")
+
+	if !strings.HasPrefix(name, "staging-env-file-") {
+		t.Errorf("envFileSecretName() = %q, want it prefixed with the environment", name)
+	}
+
+	if name != envFileSecretName("staging", "DB_PASSWORD=one\n") {
+		t.Error("envFileSecretName() differs for identical env files")
+	}
+
+	// Same keys with different values must not share a secret
+	if name == envFileSecretName("staging", "DB_PASSWORD=two\n") {
+		t.Errorf("envFileSecretName() = %q for env files with different values, want distinct names", name)
+	}
+}
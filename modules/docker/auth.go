@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger/docker/internal/dagger"
+)
+
+const (
+	// defaultPushImage provides crane for pushing with a Docker config
+	defaultPushImage = "gcr.io/go-containerregistry/crane:debug"
+	// dockerConfigDir is where a Docker config is mounted for crane, set as DOCKER_CONFIG
+	dockerConfigDir = "/root/.docker"
+)
+
+// dockerHubRegistries are the hosts Docker Hub credentials may be stored under in a Docker config,
+// once normalised by registryHost
+var dockerHubRegistries = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+type registryCredential struct {
+	// Registry is the normalised registry host, e.g. docker.io or ghcr.io
+	Registry string
+	Username string
+	Password string
+}
+
+// WithPushImage sets the image used to push with a Docker config, e.g. one providing the credential
+// helpers the config names
+func (m *Docker) WithPushImage(
+	// Image providing crane and every credential helper the Docker config names on its PATH
+	// (e.g. docker-credential-ecr-login)
+	image string,
+) *Docker {
+	m.PushImage = image
+	return m
+}
+
+// craneWithConfig returns a crane container with the Docker config mounted, so static credentials
+// and credential helpers are both used as they would be by docker push. The registry is external
+// state, so the cache is busted to always run against it
+func (m *Docker) craneWithConfig(dockerConfig *dagger.Secret) *dagger.Container {
+	image := m.PushImage
+	if image == "" {
+		image = defaultPushImage
+	}
+
+	return dag.Container().
+		From(image).
+		WithMountedSecret(dockerConfigDir+"/config.json", dockerConfig).
+		WithEnvVariable("DOCKER_CONFIG", dockerConfigDir).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+}
+
+// pushWithConfig pushes the built image to the reference with crane, authenticating with the Docker
+// config, and returns the pushed address
+func (m *Docker) pushWithConfig(ctx context.Context, dockerConfig *dagger.Secret, ref string) (string, error) {
+	address, err := m.craneWithConfig(dockerConfig).
+		WithMountedFile("/image.tar", m.Container.AsTarball()).
+		WithExec([]string{"crane", "push", "/image.tar", ref}).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(address), nil
+}
+
+// repositoryFromConfig validates a Docker config.json secret and returns the repository to publish to
+// with it (see parseConfigRepository)
+func repositoryFromConfig(ctx context.Context, dockerConfig *dagger.Secret, repository string) (string, error) {
+	contents, err := dockerConfig.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read docker config: %w", err)
+	}
+
+	return parseConfigRepository(contents, repository)
+}
+
+// parseConfigRepository validates a Docker config and returns the repository to publish to, or the
+// <username>/cloud Docker Hub repository of its static docker.io credentials when none is set.
+// Credential helpers don't reveal a username, so configs without one need a repository
+func parseConfigRepository(contents string, repository string) (string, error) {
+	creds, err := parseDockerConfig(contents)
+	if err != nil {
+		return "", err
+	}
+
+	if repository != "" {
+		return repository, nil
+	}
+
+	hub, ok := hubCredential(creds)
+	if !ok {
+		return "", ErrNoRepository
+	}
+
+	return hubRepository(hub.Username), nil
+}
+
+// hubCredential returns the Docker Hub credential among the parsed credentials
+func hubCredential(creds []registryCredential) (registryCredential, bool) {
+	for _, cred := range creds {
+		if cred.Registry == "docker.io" {
+			return cred, true
+		}
+	}
+
+	return registryCredential{}, false
+}
+
+// registryHost normalises a Docker config auths key such as https://index.docker.io/v1/ or
+// https://ghcr.io to the registry host image references use, mapping Docker Hub aliases to docker.io
+func registryHost(key string) string {
+	host := key
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+
+	host, _, _ = strings.Cut(host, "/")
+	host = strings.ToLower(host)
+
+	if slices.Contains(dockerHubRegistries, host) {
+		return "docker.io"
+	}
+
+	return host
+}
+
+// parseDockerConfig validates a Docker config.json and returns its static registry credentials.
+// Configs relying on credential helpers are valid without any static credentials
+func parseDockerConfig(contents string) ([]registryCredential, error) {
+	var config dockerConfigFile
+	if err := json.Unmarshal([]byte(contents), &config); err != nil {
+		return nil, fmt.Errorf("docker config is not valid JSON: %w", err)
+	}
+
+	creds := make([]registryCredential, 0, len(config.Auths))
+
+	// Keys are visited in order so the credential kept when several alias the same host is stable
+	keys := make([]string, 0, len(config.Auths))
+	for key := range config.Auths {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, registry := range keys {
+		auth := config.Auths[registry]
+		username, password := auth.Username, auth.Password
+
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for registry %s: %w", registry, err)
+			}
+
+			var ok bool
+			username, password, ok = strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth for registry %s: expected username:password", registry)
+			}
+		}
+
+		host := registryHost(registry)
+		if username == "" || password == "" || slices.ContainsFunc(creds, func(c registryCredential) bool { return c.Registry == host }) {
+			continue
+		}
+
+		creds = append(creds, registryCredential{Registry: host, Username: username, Password: password})
+	}
+
+	if len(creds) == 0 && config.CredsStore == "" && len(config.CredHelpers) == 0 {
+		return nil, fmt.Errorf("docker config contains no registry credentials or credential helpers")
+	}
+
+	return creds, nil
+}
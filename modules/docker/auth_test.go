@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"https://index.docker.io/v1/", "docker.io"},
+		{"index.docker.io", "docker.io"},
+		{"registry-1.docker.io", "docker.io"},
+		{"docker.io", "docker.io"},
+		{"https://ghcr.io", "ghcr.io"},
+		{"GHCR.IO", "ghcr.io"},
+		{"registry.example.com:5000/v2/", "registry.example.com:5000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := registryHost(tt.key); got != tt.want {
+				t.Errorf("registryHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDockerConfig(t *testing.T) {
+	contents := `{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "YWxpY2U6aHViLXBhc3M="},
+    "https://ghcr.io": {"username": "bot", "password": "ghcr-pass"},
+    "registry.example.com": {}
+  }
+}`
+
+	got, err := parseDockerConfig(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Credentials are ordered by their config key
+	want := []registryCredential{
+		{Registry: "ghcr.io", Username: "bot", Password: "ghcr-pass"},
+		{Registry: "docker.io", Username: "alice", Password: "hub-pass"},
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("parseDockerConfig() = %+v, want %+v", got, want)
+	}
+
+	if hub, ok := hubCredential(got); !ok || hub.Username != "alice" {
+		t.Errorf("hubCredential() = %+v, %t, want the docker.io credential", hub, ok)
+	}
+}
+
+func TestParseDockerConfigAliases(t *testing.T) {
+	// Both keys normalise to docker.io, so the first in sorted order is kept
+	contents := `{"auths": {
+    "https://index.docker.io/v1/": {"username": "alice", "password": "first"},
+    "docker.io": {"username": "bob", "password": "second"}
+  }}`
+
+	got, err := parseDockerConfig(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []registryCredential{{Registry: "docker.io", Username: "bob", Password: "second"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseDockerConfig() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseDockerConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"not json", `auths`, "not valid JSON"},
+		{"invalid base64", `{"auths": {"ghcr.io": {"auth": "%%%"}}}`, "invalid auth for registry ghcr.io"},
+		{"auth without separator", `{"auths": {"ghcr.io": {"auth": "bm9jb2xvbg=="}}}`, "expected username:password"},
+		{"no credentials", `{"auths": {"ghcr.io": {}}}`, "no registry credentials"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDockerConfig(tt.contents)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseDockerConfig() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseDockerConfigCredentialHelpers(t *testing.T) {
+	for _, contents := range []string{
+		`{"credsStore": "desktop"}`,
+		`{"auths": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": {}}, "credHelpers": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"}}`,
+	} {
+		got, err := parseDockerConfig(contents)
+		if err != nil {
+			t.Errorf("parseDockerConfig(%s) error = %v, want helper-only configs accepted", contents, err)
+		}
+
+		if len(got) != 0 {
+			t.Errorf("parseDockerConfig(%s) = %+v, want no static credentials", contents, got)
+		}
+	}
+}
+
+func TestParseConfigRepository(t *testing.T) {
+	hub := `{"auths": {"https://index.docker.io/v1/": {"auth": "YWxpY2U6aHViLXBhc3M="}}}`
+	ecr := `{"credHelpers": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"}}`
+
+	tests := []struct {
+		name       string
+		contents   string
+		repository string
+		want       string
+		wantErr    string
+	}{
+		{"docker hub username", hub, "", "alice/cloud", ""},
+		{"repository with static credentials", hub, "ghcr.io/acme/cloud", "ghcr.io/acme/cloud", ""},
+		{"repository with credential helpers", ecr, "123456789012.dkr.ecr.us-east-1.amazonaws.com/cloud", "123456789012.dkr.ecr.us-east-1.amazonaws.com/cloud", ""},
+		{"credential helpers without a repository", ecr, "", "", "WithRepository"},
+		{"invalid config with a repository", `auths`, "ghcr.io/acme/cloud", "", "not valid JSON"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfigRepository(tt.contents, tt.repository)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseConfigRepository() error = %v, want one containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("parseConfigRepository() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "fmt"
+
+var ErrTagExists = fmt.Errorf("tag already exists in the registry and is treated as immutable")
+
+var ErrNoRepository = fmt.Errorf("docker config has no docker.io credentials to publish to <username>/cloud with, set a repository with WithRepository")
@@ -3,26 +3,53 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"dagger/docker/internal/dagger"
 )
 
 const (
 	registryRepo = "cloud"
+	// buildArgsSecret is the Infisical secret holding an environment's build args in dotenv format
+	buildArgsSecret = "DOCKER_BUILD_ARGS"
+	// buildContextsDir is where named build contexts are placed inside the build context
+	buildContextsDir = ".build-contexts"
+	// cacheBusterArg is the build arg every stage declares when building without the cache
+	cacheBusterArg = "CACHE_BUSTER"
 )
 
+// buildContextNamePattern matches names usable as a Dockerfile stage name
+var buildContextNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
 type Docker struct {
+	// +private
+	BuildArgs []string
+	// +private
+	BuildContextNames []string
+	// +private
+	BuildContexts []*dagger.Directory
 	// +private
 	Container *dagger.Container
 	// +private
+	Dockerfile string
+	// +private
 	Environment string
 	// +private
 	InfisicalClientSecret *dagger.Secret
 	// +private
+	PushImage string
+	// +private
 	RepoName string
 	// +private
+	Repository string
+	// +private
 	Source *dagger.Directory
 }
 
@@ -45,30 +72,315 @@ func New(
 	}
 }
 
-// Build builds the Dockerfile present in the source directory
+// WithBuildContext adds a named build context that the Dockerfile can reference with
+// COPY --from=<name>, e.g. for sharing sibling directories in a monorepo. Adding a name again
+// replaces its directory. Contexts are staged under .build-contexts in the main build context, so
+// a broad COPY . also picks them up
+func (m *Docker) WithBuildContext(
+	// Name the Dockerfile refers to the context by
+	name string,
+	// Directory to use as the context
+	directory *dagger.Directory,
+) (*Docker, error) {
+	if !buildContextNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid build context name %s: must be lowercase alphanumeric, '.', '_' or '-'", name)
+	}
+
+	if i := slices.Index(m.BuildContextNames, name); i >= 0 {
+		m.BuildContexts[i] = directory
+		return m, nil
+	}
+
+	m.BuildContextNames = append(m.BuildContextNames, name)
+	m.BuildContexts = append(m.BuildContexts, directory)
+
+	return m, nil
+}
+
+// Build builds the Dockerfile present in the source directory. Dagger's Docker build does not
+// expose a network mode, so that option isn't available
 func (m *Docker) Build(
 	ctx context.Context,
 	// Build arguments to pass to the Docker build process. Format KEY=VALUE
 	// +optional
 	buildArgs []string,
-) *Docker {
-	args := make([]dagger.BuildArg, 0)
+	// A dotenv file of build arguments. Inline build arguments take precedence
+	// +optional
+	buildArgsFile *dagger.File,
+	// Path to the Dockerfile relative to the source directory
+	// +default="Dockerfile"
+	dockerfile string,
+	// The build stage to target in a multi-stage Dockerfile
+	// +optional
+	target string,
+	// The platform to build for (e.g. linux/arm64), defaults to the engine's platform
+	// +optional
+	platform dagger.Platform,
+	// Glob patterns of paths to leave out of the build context (e.g. "**/node_modules")
+	// +optional
+	exclude []string,
+	// A dockerignore file to use instead of the source's .dockerignore. Negated patterns are not supported
+	// +optional
+	dockerignore *dagger.File,
+	// Rerun every RUN instruction instead of using cached results, e.g. to pick up new packages
+	// +optional
+	noCache bool,
+) (*Docker, error) {
+	if buildArgsFile != nil {
+		contents, err := buildArgsFile.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read build args file: %w", err)
+		}
 
-	for _, arg := range buildArgs {
-		parts := strings.Split(arg, "=")
-		if len(parts) == 2 {
-			args = append(args, dagger.BuildArg{
-				Name:  parts[0],
-				Value: parts[1],
-			})
+		fileArgs, err := parseEnvFile(contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse build args file: %w", err)
 		}
+
+		buildArgs = mergeBuildArgs(fileArgs, buildArgs)
 	}
 
-	m.Container = m.Source.DockerBuild(dagger.DirectoryDockerBuildOpts{
-		BuildArgs: args,
-	})
+	m.BuildArgs = buildArgs
+	m.Dockerfile = dockerfile
+	buildContext, err := m.buildContext(ctx, exclude, dockerignore)
+	if err != nil {
+		return nil, err
+	}
 
-	return m
+	if len(m.BuildContextNames) > 0 || noCache {
+		buildContext, dockerfile, err = m.rewriteDockerfile(ctx, buildContext, dockerfile, noCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cacheBuster := ""
+	if noCache {
+		cacheBuster = time.Now().String()
+	}
+
+	m.Container = buildContext.DockerBuild(dockerBuildOpts(buildArgs, dockerfile, target, platform, cacheBuster))
+
+	return m, nil
+}
+
+// dockerBuildOpts returns the Docker build options for the Build parameters. A non-empty cache
+// buster is passed as the build arg declared by a Dockerfile rewritten with injectCacheBuster
+func dockerBuildOpts(buildArgs []string, dockerfile string, target string, platform dagger.Platform, cacheBuster string) dagger.DirectoryDockerBuildOpts {
+	args := parseBuildArgs(buildArgs)
+	if cacheBuster != "" {
+		args = append(args, dagger.BuildArg{Name: cacheBusterArg, Value: cacheBuster})
+	}
+
+	return dagger.DirectoryDockerBuildOpts{
+		BuildArgs:  args,
+		Dockerfile: dockerfile,
+		Platform:   platform,
+		Target:     target,
+	}
+}
+
+// buildContext returns the source directory with excluded paths removed. A custom dockerignore
+// replaces the source's own so only its patterns apply
+func (m *Docker) buildContext(ctx context.Context, exclude []string, dockerignore *dagger.File) (*dagger.Directory, error) {
+	buildContext := m.Source
+
+	if dockerignore != nil {
+		contents, err := dockerignore.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dockerignore: %w", err)
+		}
+
+		patterns, err := parseDockerignore(contents)
+		if err != nil {
+			return nil, err
+		}
+
+		exclude = append(exclude, patterns...)
+		buildContext = buildContext.WithoutFile(".dockerignore")
+	}
+
+	if len(exclude) == 0 {
+		return buildContext, nil
+	}
+
+	return buildContext.Filter(dagger.DirectoryFilterOpts{Exclude: exclude}), nil
+}
+
+// rewriteDockerfile returns the build context with the named contexts added and the path of a copy
+// of the Dockerfile rewritten to use them. Dagger's Docker build has no --build-context option, so
+// each context becomes a scratch stage of the same name copied from a subdirectory of the build
+// context. Nor does it have --no-cache, so with noCache every stage declares a cache busting arg
+func (m *Docker) rewriteDockerfile(ctx context.Context, buildContext *dagger.Directory, dockerfile string, noCache bool) (*dagger.Directory, string, error) {
+	rewritten, err := m.Source.File(dockerfile).Contents(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", dockerfile, err)
+	}
+
+	if len(m.BuildContextNames) > 0 {
+		rewritten, err = injectBuildContexts(rewritten, m.BuildContextNames)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if noCache {
+		rewritten = injectCacheBuster(rewritten)
+	}
+
+	for i, name := range m.BuildContextNames {
+		buildContext = buildContext.WithDirectory(path.Join(buildContextsDir, name), m.BuildContexts[i])
+	}
+
+	rewrittenPath := path.Join(buildContextsDir, "Dockerfile")
+
+	return buildContext.WithNewFile(rewrittenPath, rewritten), rewrittenPath, nil
+}
+
+// injectCacheBuster declares the cache buster build arg at the start of every stage. Build args are
+// part of the cache key of the RUN instructions after them, so a new value reruns every one
+func injectCacheBuster(dockerfile string) string {
+	lines := strings.Split(dockerfile, "\n")
+	rewritten := make([]string, 0, len(lines))
+	inFrom := false
+
+	for _, line := range lines {
+		rewritten = append(rewritten, line)
+
+		if fields := strings.Fields(line); len(fields) > 0 && strings.EqualFold(fields[0], "FROM") {
+			inFrom = true
+		}
+
+		// A FROM instruction may continue over several lines
+		if inFrom && !strings.HasSuffix(strings.TrimSpace(line), "\\") {
+			rewritten = append(rewritten, "ARG "+cacheBusterArg)
+			inFrom = false
+		}
+	}
+
+	return strings.Join(rewritten, "\n")
+}
+
+// injectBuildContexts inserts a stage for each named context before the first FROM instruction,
+// after any parser directives and global ARGs
+func injectBuildContexts(dockerfile string, names []string) (string, error) {
+	lines := strings.Split(dockerfile, "\n")
+	first := -1
+
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		if first < 0 {
+			first = i
+		}
+
+		if len(fields) >= 4 && strings.EqualFold(fields[len(fields)-2], "AS") && slices.Contains(names, strings.ToLower(fields[len(fields)-1])) {
+			return "", fmt.Errorf("build context %s conflicts with a stage of the same name", fields[len(fields)-1])
+		}
+	}
+
+	if first < 0 {
+		return "", fmt.Errorf("dockerfile has no FROM instruction")
+	}
+
+	stages := make([]string, 0, len(names)*3)
+	for _, name := range names {
+		stages = append(stages, "FROM scratch AS "+name, "COPY "+path.Join(buildContextsDir, name)+"/ /", "")
+	}
+
+	return strings.Join(slices.Concat(lines[:first], stages, lines[first:]), "\n"), nil
+}
+
+// parseDockerignore returns the exclusion patterns in a dockerignore file, ignoring comments and blank lines
+func parseDockerignore(contents string) ([]string, error) {
+	var patterns []string
+
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			return nil, fmt.Errorf("negated dockerignore pattern %s is not supported", line)
+		}
+
+		patterns = append(patterns, strings.TrimPrefix(line, "/"))
+	}
+
+	return patterns, nil
+}
+
+// Lint runs hadolint against the Dockerfile and returns the findings, failing on findings at or
+// above the given severity
+func (m *Docker) Lint(
+	ctx context.Context,
+	// Path to the Dockerfile relative to the source directory
+	// +default="Dockerfile"
+	dockerfile string,
+	// Minimum severity that fails the lint (error, warning, info, style, ignore, none)
+	// +default="error"
+	failureThreshold string,
+) (string, error) {
+	args, err := lintArgs(dockerfile, failureThreshold)
+	if err != nil {
+		return "", err
+	}
+
+	ctr := dag.Container().
+		From("hadolint/hadolint:latest-alpine").
+		WithMountedDirectory("/src", m.Source).
+		WithWorkdir("/src").
+		WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to lint %s: %w", dockerfile, err)
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read lint output: %w", err)
+	}
+
+	return lintResult(out, exitCode, dockerfile, failureThreshold)
+}
+
+// lintArgs returns the hadolint command for the Dockerfile and failure threshold
+func lintArgs(dockerfile string, failureThreshold string) ([]string, error) {
+	switch failureThreshold {
+	case "error", "warning", "info", "style", "ignore", "none":
+	default:
+		return nil, fmt.Errorf("invalid failure threshold: %s", failureThreshold)
+	}
+
+	return []string{"hadolint", "--failure-threshold", failureThreshold, dockerfile}, nil
+}
+
+// lintResult returns the hadolint findings, failing with them when hadolint exited non-zero
+func lintResult(out string, exitCode int, dockerfile string, failureThreshold string) (string, error) {
+	if exitCode != 0 {
+		return out, fmt.Errorf("%s has findings at or above %s severity:\n%s", dockerfile, failureThreshold, out)
+	}
+
+	return out, nil
+}
+
+// WithRepository publishes to the given image repository instead of <Docker Hub username>/cloud,
+// e.g. an ECR or GCR repository authenticated through a Docker config's credential helpers
+func (m *Docker) WithRepository(
+	// The image repository without a tag (e.g. 123456789012.dkr.ecr.us-east-1.amazonaws.com/cloud)
+	repository string,
+) (*Docker, error) {
+	if repository == "" || strings.ContainsAny(repository, "@ ") || strings.HasSuffix(repository, "/") {
+		return nil, fmt.Errorf("invalid repository: %q", repository)
+	}
+
+	m.Repository = repository
+	return m, nil
 }
 
 // BuildContainer builds the passed in Docker container
@@ -82,16 +394,368 @@ func (m *Docker) GetContainer(ctx context.Context) (*dagger.Container, error) {
 	return m.Container.Sync(ctx)
 }
 
-// Publish builds and pushes the container image to Docker Hub
-func (m *Docker) Publish(ctx context.Context) (string, error) {
+// ExportOCI returns the built image as an OCI image layout directory (index.json, oci-layout and
+// blobs), for validating the artifact without a registry. Write it to the host with `export --path`
+func (m *Docker) ExportOCI(ctx context.Context) (*dagger.Directory, error) {
+	if m.Container == nil {
+		return nil, fmt.Errorf("container is not built yet")
+	}
+
+	return dag.Container().
+		From("alpine:latest").
+		WithMountedFile("/image.tar", m.ociTarball()).
+		WithExec([]string{"mkdir", "-p", "/oci"}).
+		WithExec([]string{"tar", "-xf", "/image.tar", "-C", "/oci"}).
+		Directory("/oci"), nil
+}
+
+// Size returns the compressed size in bytes of the built image, the sum of its layer sizes as
+// they would be pushed to a registry
+func (m *Docker) Size(ctx context.Context) (int, error) {
+	if m.Container == nil {
+		return 0, fmt.Errorf("container is not built yet")
+	}
+
+	digest, err := m.imageDigest(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	contents, err := dag.Container().
+		From("alpine:latest").
+		WithMountedFile("/image.tar", m.ociTarball()).
+		WithExec([]string{"tar", "-xOf", "/image.tar", "blobs/" + strings.Replace(digest, ":", "/", 1)}).
+		Stdout(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read image manifest: %w", err)
+	}
+
+	var manifest struct {
+		Layers []struct {
+			Size int `json:"size"`
+		} `json:"layers"`
+	}
+
+	if err := json.Unmarshal([]byte(contents), &manifest); err != nil {
+		return 0, fmt.Errorf("failed to parse image manifest: %w", err)
+	}
+
+	size := 0
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	return size, nil
+}
+
+// ociTarball returns the built container as a tarball using OCI media types
+func (m *Docker) ociTarball() *dagger.File {
+	return m.Container.AsTarball(dagger.ContainerAsTarballOpts{
+		MediaTypes: dagger.ImageMediaTypesOcimediaTypes,
+	})
+}
+
+// Publish builds and pushes the container image to Docker Hub, or the repository set with WithRepository
+func (m *Docker) Publish(
+	ctx context.Context,
+	// A Docker config.json to push with instead of the Infisical Docker Hub credentials. It is
+	// mounted for crane, so credential helpers work when the push image provides them (see WithPushImage)
+	// +optional
+	dockerConfig *dagger.Secret,
+	// Fail instead of publishing when the compressed image size exceeds this many bytes
+	// +optional
+	maxBytes int,
+	// Refuse to overwrite the tag if it already exists in the registry, e.g. for version tags
+	// +optional
+	failIfTagExists bool,
+) (string, error) {
+	if err := m.checkPublishable(); err != nil {
+		return "", err
+	}
+
+	if maxBytes > 0 {
+		size, err := m.Size(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to check image size: %w", err)
+		}
+
+		if size > maxBytes {
+			return "", fmt.Errorf("image size %d bytes exceeds the limit of %d bytes", size, maxBytes)
+		}
+	}
+
+	repository, err := m.repository(ctx, dockerConfig)
+	if err != nil {
+		return "", err
+	}
+
+	ref := imageRef(repository, m.envTag())
+
+	if failIfTagExists {
+		exists, err := m.tagExists(ctx, ref, dockerConfig)
+		if err != nil {
+			return "", err
+		}
+
+		if exists {
+			return "", fmt.Errorf("%w: %s", ErrTagExists, ref)
+		}
+	}
+
+	address, err := m.push(ctx, dockerConfig, ref)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to publish image: %w", err)
+	}
+
+	return address, nil
+}
+
+// PublishVersioned pushes the container image to Docker Hub tagged with both the given version
+// and the environment, returning the published addresses
+func (m *Docker) PublishVersioned(
+	ctx context.Context,
+	// The semantic version to tag the image with (e.g. v1.2.3)
+	version string,
+	// A Docker config.json to push with instead of the Infisical Docker Hub credentials (see Publish)
+	// +optional
+	dockerConfig *dagger.Secret,
+) ([]string, error) {
+	if err := m.checkPublishable(); err != nil {
+		return nil, err
+	}
+
+	if version == "" {
+		return nil, fmt.Errorf("version is not set")
+	}
+
+	return m.publishTags(ctx, []string{m.RepoName + "-" + version, m.envTag()}, dockerConfig)
+}
+
+// PublishTags pushes the container image to Docker Hub under each of the given tags, prefixed with
+// the repository name, returning the published addresses. Every tag points at the same digest.
+// The latest tag is skipped unless the image was built from latestOnBranch, so feature branches
+// can't move it, with the reason returned in place of its address
+func (m *Docker) PublishTags(
+	ctx context.Context,
+	// Tags to publish (e.g. latest, v1.2.3, staging), published as <repo>-<tag>
+	tags []string,
+	// A Docker config.json to push with instead of the Infisical Docker Hub credentials (see Publish)
+	// +optional
+	dockerConfig *dagger.Secret,
+	// Branch the image was built from, detected from the source checkout when empty. CI checkouts
+	// are often detached, so pass it explicitly there (e.g. $GITHUB_REF_NAME)
+	// +optional
+	branch string,
+	// Only publish the latest tag from this branch, defaults to the source's default branch
+	// +optional
+	latestOnBranch string,
+) ([]string, error) {
+	if err := m.checkPublishable(); err != nil {
+		return nil, err
+	}
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("no tags provided")
+	}
+
+	var skipped []string
+	if slices.Contains(tags, "latest") {
+		if reason := m.latestSkipReason(ctx, branch, latestOnBranch); reason != "" {
+			tags = slices.DeleteFunc(slices.Clone(tags), func(tag string) bool { return tag == "latest" })
+			skipped = append(skipped, "skipped the latest tag: "+reason)
+		}
+	}
+
+	prefixed := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == "" {
+			return nil, fmt.Errorf("tags must not be empty")
+		}
+
+		if tag := m.RepoName + "-" + tag; !slices.Contains(prefixed, tag) {
+			prefixed = append(prefixed, tag)
+		}
+	}
+
+	if len(prefixed) == 0 {
+		return append([]string{}, skipped...), nil
+	}
+
+	addresses, err := m.publishTags(ctx, prefixed, dockerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(addresses, skipped...), nil
+}
+
+// latestSkipReason returns why the latest tag may not be published from the branch, or an empty
+// string if it may. An undetectable branch never matches
+func (m *Docker) latestSkipReason(ctx context.Context, branch string, latestOnBranch string) string {
+	if branch == "" {
+		branch = m.sourceGit(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+	}
+
+	if latestOnBranch == "" {
+		latestOnBranch = strings.TrimPrefix(m.sourceGit(ctx, "symbolic-ref", "--short", "refs/remotes/origin/HEAD"), "origin/")
+	}
+
+	switch {
+	case branch == "" || branch == "HEAD":
+		return "the source branch can't be detected, pass branch to publish it"
+	case latestOnBranch == "":
+		return "the default branch can't be detected, pass latestOnBranch to publish it"
+	case branch != latestOnBranch:
+		return fmt.Sprintf("branch %s is not %s", branch, latestOnBranch)
+	default:
+		return ""
+	}
+}
+
+// publishTags pushes the container under each tag and checks every tag resolved to the same digest.
+// The image is built once, so pushes after the first find the layers already present and only
+// upload the manifest
+func (m *Docker) publishTags(ctx context.Context, tags []string, dockerConfig *dagger.Secret) ([]string, error) {
+	repository, err := m.repository(ctx, dockerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(tags))
+	var digest string
+
+	for _, tag := range tags {
+		address, err := m.push(ctx, dockerConfig, imageRef(repository, tag))
+		if err != nil {
+			return nil, fmt.Errorf("failed to publish image as %s: %w", tag, err)
+		}
+
+		_, tagDigest, _ := strings.Cut(address, "@")
+		if digest == "" {
+			digest = tagDigest
+		} else if tagDigest != digest {
+			return nil, fmt.Errorf("tag %s was published with digest %s, expected %s", tag, tagDigest, digest)
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// tagExists reports whether the image reference already resolves to a manifest in the registry.
+// The registry is external state, so the cache is busted to always check it for real
+func (m *Docker) tagExists(ctx context.Context, ref string, dockerConfig *dagger.Secret) (bool, error) {
+	var ctr *dagger.Container
+
+	if dockerConfig != nil {
+		ctr = m.craneWithConfig(dockerConfig).
+			WithExec([]string{"crane", "digest", ref}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+	} else {
+		username, password, err := m.hubCredentials(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		ctr = dag.Container().
+			From(defaultPushImage).
+			WithEnvVariable("REGISTRY_USERNAME", username).
+			WithSecretVariable("REGISTRY_PASSWORD", password).
+			WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+			WithExec([]string{"sh", "-c", `echo "$REGISTRY_PASSWORD" | crane auth login index.docker.io -u "$REGISTRY_USERNAME" --password-stdin >/dev/null && crane digest "$0"`, ref},
+				dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+	}
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for tag %s: %w", ref, err)
+	}
+
+	if exitCode == 0 {
+		return true, nil
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to read tag check output: %w", err)
+	}
+
+	if strings.Contains(out, "MANIFEST_UNKNOWN") || strings.Contains(out, "NOT_FOUND") {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("failed to check for tag %s:\n%s", ref, out)
+}
+
+// checkPublishable returns an error if the image can't be published yet
+func (m *Docker) checkPublishable() error {
 	if m.Container == nil {
-		return "", fmt.Errorf("container is not built yet")
+		return fmt.Errorf("container is not built yet")
 	}
 
 	if m.RepoName == "" {
-		return "", fmt.Errorf("repository name is not set")
+		return fmt.Errorf("repository name is not set")
+	}
+
+	return nil
+}
+
+// envTag returns the image tag for the repository and environment
+func (m *Docker) envTag() string {
+	if m.Environment == "" {
+		return m.RepoName
+	}
+
+	return m.RepoName + "-" + m.Environment
+}
+
+// imageRef returns the full image reference for a tag in the repository
+func imageRef(repository string, tag string) string {
+	return repository + ":" + tag
+}
+
+// hubRepository returns the Docker Hub repository images are published to for a username
+func hubRepository(username string) string {
+	return username + "/" + registryRepo
+}
+
+// repository returns the image repository to publish to: the one set with WithRepository, or
+// <Docker Hub username>/cloud with the username from the Docker config or Infisical
+func (m *Docker) repository(ctx context.Context, dockerConfig *dagger.Secret) (string, error) {
+	if dockerConfig != nil {
+		return repositoryFromConfig(ctx, dockerConfig, m.Repository)
+	}
+
+	if m.Repository != "" {
+		return m.Repository, nil
 	}
 
+	username, _, err := m.hubCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return hubRepository(username), nil
+}
+
+// push publishes the built image to the reference and returns its address, pushing with crane when
+// a Docker config is given and with the Infisical Docker Hub credentials otherwise
+func (m *Docker) push(ctx context.Context, dockerConfig *dagger.Secret, ref string) (string, error) {
+	if dockerConfig != nil {
+		return m.pushWithConfig(ctx, dockerConfig, ref)
+	}
+
+	username, password, err := m.hubCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return m.Container.WithRegistryAuth("docker.io", username, password).Publish(ctx, ref)
+}
+
+// hubCredentials returns the Docker Hub username and password from Infisical
+func (m *Docker) hubCredentials(ctx context.Context) (string, *dagger.Secret, error) {
 	env := m.Environment
 	if env == "" {
 		env = "staging"
@@ -99,26 +763,162 @@ func (m *Docker) Publish(ctx context.Context) (string, error) {
 
 	infisical := dag.Infisical(m.InfisicalClientSecret, env)
 
-	username := infisical.GetSecret("DOCKERHUB_USERNAME")
-	password := infisical.GetSecret("DOCKERHUB_PASSWORD")
+	username, err := infisical.GetSecret("DOCKERHUB_USERNAME").Plaintext(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get dockerhub username: %w", err)
+	}
+
+	return username, infisical.GetSecret("DOCKERHUB_PASSWORD"), nil
+}
 
-	usernameString, err := username.Plaintext(ctx)
+// BuildArgsFor returns the build args stored in Infisical for the given environment, in KEY=VALUE format
+func (m *Docker) BuildArgsFor(ctx context.Context, env string) ([]string, error) {
+	contents, err := dag.Infisical(m.InfisicalClientSecret, env).
+		GetSecret(buildArgsSecret).
+		Plaintext(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to get dockerhub username: %w", err)
+		return nil, fmt.Errorf("failed to get build args for %s: %w", env, err)
 	}
 
-	imageTag := fmt.Sprintf("%s/%s:%s-%s", usernameString, registryRepo, m.RepoName, m.Environment)
-	if m.Environment == "" {
-		imageTag = fmt.Sprintf("%s/%s:%s", usernameString, registryRepo, m.RepoName)
+	args, err := parseEnvFile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse build args for %s: %w", env, err)
 	}
 
-	address, err := m.Container.
-		WithRegistryAuth("docker.io", usernameString, password).
-		Publish(ctx, imageTag)
+	return args, nil
+}
 
+// DiffBuildArgs reports the build args that differ between two environments, one per line.
+// Values of sensitive build args are redacted
+func (m *Docker) DiffBuildArgs(ctx context.Context, envA string, envB string) (string, error) {
+	argsA, err := m.BuildArgsFor(ctx, envA)
 	if err != nil {
-		return "", fmt.Errorf("failed to publish image: %w", err)
+		return "", err
 	}
 
-	return address, nil
+	argsB, err := m.BuildArgsFor(ctx, envB)
+	if err != nil {
+		return "", err
+	}
+
+	return diffBuildArgs(envA, argsA, envB, argsB), nil
+}
+
+// diffBuildArgs formats the differences between two sets of KEY=VALUE build args, sorted by name
+func diffBuildArgs(envA string, argsA []string, envB string, argsB []string) string {
+	valuesA := make(map[string]string)
+	for _, arg := range parseBuildArgs(argsA) {
+		valuesA[arg.Name] = arg.Value
+	}
+
+	valuesB := make(map[string]string)
+	for _, arg := range parseBuildArgs(argsB) {
+		valuesB[arg.Name] = arg.Value
+	}
+
+	names := make([]string, 0, len(valuesA)+len(valuesB))
+	for name := range valuesA {
+		names = append(names, name)
+	}
+
+	for name := range valuesB {
+		if _, ok := valuesA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	display := func(name, value string) string {
+		if isSensitiveArg(name) {
+			return redactedValue
+		}
+
+		return value
+	}
+
+	var lines []string
+	for _, name := range names {
+		a, inA := valuesA[name]
+		b, inB := valuesB[name]
+
+		switch {
+		case !inB:
+			lines = append(lines, fmt.Sprintf("- %s (only in %s): %s", name, envA, display(name, a)))
+		case !inA:
+			lines = append(lines, fmt.Sprintf("+ %s (only in %s): %s", name, envB, display(name, b)))
+		case a != b:
+			lines = append(lines, fmt.Sprintf("~ %s: %s=%s, %s=%s", name, envA, display(name, a), envB, display(name, b)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// parseBuildArgs converts KEY=VALUE strings into Docker build arguments, skipping malformed entries
+func parseBuildArgs(buildArgs []string) []dagger.BuildArg {
+	args := make([]dagger.BuildArg, 0)
+
+	for _, arg := range buildArgs {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 {
+			args = append(args, dagger.BuildArg{
+				Name:  parts[0],
+				Value: parts[1],
+			})
+		}
+	}
+
+	return args
+}
+
+// parseEnvFile parses dotenv formatted contents into KEY=VALUE strings, ignoring blank lines and
+// comments and unquoting quoted values
+func parseEnvFile(contents string) ([]string, error) {
+	args := make([]string, 0)
+
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0]:
+			value = value[1 : len(value)-1]
+		case strings.Contains(value, " #"):
+			// Unquoted values may have trailing comments
+			value = strings.TrimSpace(value[:strings.Index(value, " #")])
+		}
+
+		args = append(args, key+"="+value)
+	}
+
+	return args, nil
+}
+
+// mergeBuildArgs combines two lists of KEY=VALUE build arguments, with overrides taking precedence
+func mergeBuildArgs(base, overrides []string) []string {
+	merged := make([]string, 0, len(base)+len(overrides))
+	index := make(map[string]int)
+
+	for _, arg := range append(base, overrides...) {
+		key, _, _ := strings.Cut(arg, "=")
+		if i, ok := index[key]; ok {
+			merged[i] = arg
+			continue
+		}
+
+		index[key] = len(merged)
+		merged = append(merged, arg)
+	}
+
+	return merged
 }
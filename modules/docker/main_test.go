@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"dagger/docker/internal/dagger"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	contents := `# build settings
+NODE_ENV=production
+export API_URL = https://api.example.com
+GREETING="hello world"
+QUOTED='single # not a comment'
+PORT=3000 # trailing comment
+EMPTY=
+`
+
+	got, err := parseEnvFile(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"NODE_ENV=production",
+		"API_URL=https://api.example.com",
+		"GREETING=hello world",
+		"QUOTED=single # not a comment",
+		"PORT=3000",
+		"EMPTY=",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("parseEnvFile() = %q, want %q", got, want)
+	}
+}
+
+func TestParseEnvFileInvalid(t *testing.T) {
+	for _, contents := range []string{"NODE_ENV", "=value"} {
+		if _, err := parseEnvFile(contents); err == nil {
+			t.Errorf("parseEnvFile(%q) succeeded, want an error", contents)
+		}
+	}
+}
+
+func TestMergeBuildArgs(t *testing.T) {
+	base := []string{"NODE_ENV=development", "API_URL=http://localhost"}
+	overrides := []string{"NODE_ENV=production", "VERSION=1.2.3"}
+
+	got := mergeBuildArgs(base, overrides)
+	want := []string{"NODE_ENV=production", "API_URL=http://localhost", "VERSION=1.2.3"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("mergeBuildArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestDiffBuildArgs(t *testing.T) {
+	staging := []string{"API_URL=https://staging.example.com", "LOG_LEVEL=debug", "NPM_TOKEN=staging-token", "REGION=eu"}
+	production := []string{"API_URL=https://example.com", "NPM_TOKEN=production-token", "REGION=eu", "REPLICAS=3"}
+
+	want := `~ API_URL: staging=https://staging.example.com, production=https://example.com
+- LOG_LEVEL (only in staging): debug
+~ NPM_TOKEN: staging=[REDACTED], production=[REDACTED]
++ REPLICAS (only in production): 3`
+
+	if got := diffBuildArgs("staging", staging, "production", production); got != want {
+		t.Errorf("diffBuildArgs() =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := diffBuildArgs("staging", staging, "copy", staging); got != "" {
+		t.Errorf("diffBuildArgs() of identical args = %q, want empty", got)
+	}
+}
+
+func TestParseDockerignore(t *testing.T) {
+	contents := `# dependencies
+node_modules
+
+/dist
+*.log
+  .git  
+`
+
+	got, err := parseDockerignore(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"node_modules", "dist", "*.log", ".git"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseDockerignore() = %q, want %q", got, want)
+	}
+
+	if _, err := parseDockerignore("*.md\n!README.md"); err == nil {
+		t.Error("parseDockerignore() with a negated pattern succeeded, want an error")
+	}
+}
+
+func TestInjectBuildContexts(t *testing.T) {
+	dockerfile := `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.25
+FROM golang:${GO_VERSION} AS build
+COPY --from=shared / /src/shared`
+
+	got, err := injectBuildContexts(dockerfile, []string{"shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.25
+FROM scratch AS shared
+COPY .build-contexts/shared/ /
+
+FROM golang:${GO_VERSION} AS build
+COPY --from=shared / /src/shared`
+
+	if got != want {
+		t.Errorf("injectBuildContexts() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInjectBuildContextsInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+	}{
+		{"conflicting stage", "FROM golang:1.25 AS Shared\nFROM alpine"},
+		{"no FROM instruction", "ARG VERSION=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := injectBuildContexts(tt.dockerfile, []string{"shared"}); err == nil {
+				t.Error("injectBuildContexts() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestLatestSkipReason(t *testing.T) {
+	tests := []struct {
+		name           string
+		branch         string
+		latestOnBranch string
+		want           string
+	}{
+		{"default branch", "main", "main", ""},
+		{"feature branch", "feature/login", "main", "branch feature/login is not main"},
+		{"detached checkout", "HEAD", "main", "the source branch can't be detected, pass branch to publish it"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Docker{}
+			if got := m.latestSkipReason(context.Background(), tt.branch, tt.latestOnBranch); got != tt.want {
+				t.Errorf("latestSkipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectCacheBuster(t *testing.T) {
+	dockerfile := `# syntax=docker/dockerfile:1
+ARG NODE_VERSION=20
+FROM node:${NODE_VERSION}-alpine AS build
+RUN npm ci
+FROM \\
+  nginx:alpine
+COPY --from=build /app/dist /usr/share/nginx/html`
+
+	want := `# syntax=docker/dockerfile:1
+ARG NODE_VERSION=20
+FROM node:${NODE_VERSION}-alpine AS build
+ARG CACHE_BUSTER
+RUN npm ci
+FROM \\
+  nginx:alpine
+ARG CACHE_BUSTER
+COPY --from=build /app/dist /usr/share/nginx/html`
+
+	if got := injectCacheBuster(dockerfile); got != want {
+		t.Errorf("injectCacheBuster() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDockerBuildOpts(t *testing.T) {
+	got := dockerBuildOpts([]string{"NODE_ENV=production", "malformed"}, ".build-contexts/Dockerfile", "runtime", "linux/arm64", "")
+
+	want := dagger.DirectoryDockerBuildOpts{
+		BuildArgs:  []dagger.BuildArg{{Name: "NODE_ENV", Value: "production"}},
+		Dockerfile: ".build-contexts/Dockerfile",
+		Platform:   "linux/arm64",
+		Target:     "runtime",
+	}
+
+	if !slices.Equal(got.BuildArgs, want.BuildArgs) || got.Dockerfile != want.Dockerfile || got.Platform != want.Platform || got.Target != want.Target {
+		t.Errorf("dockerBuildOpts() = %+v, want %+v", got, want)
+	}
+
+	noCache := dockerBuildOpts(nil, "Dockerfile", "", "", "2026-10-14 12:00:00")
+	if !slices.Equal(noCache.BuildArgs, []dagger.BuildArg{{Name: "CACHE_BUSTER", Value: "2026-10-14 12:00:00"}}) {
+		t.Errorf("dockerBuildOpts() build args = %+v, want the cache buster", noCache.BuildArgs)
+	}
+}
+
+func TestLintArgs(t *testing.T) {
+	got, err := lintArgs("docker/Dockerfile.prod", "warning")
+	if err != nil {
+		t.Fatalf("lintArgs() error = %v", err)
+	}
+
+	if want := []string{"hadolint", "--failure-threshold", "warning", "docker/Dockerfile.prod"}; !slices.Equal(got, want) {
+		t.Errorf("lintArgs() = %q, want %q", got, want)
+	}
+
+	for _, threshold := range []string{"", "critical", "ERROR"} {
+		if _, err := lintArgs("Dockerfile", threshold); err == nil {
+			t.Errorf("lintArgs() with threshold %q succeeded, want an error", threshold)
+		}
+	}
+}
+
+func TestLintResult(t *testing.T) {
+	// hadolint's output for a Dockerfile using apt-get without pinned versions or cleanup
+	findings := `Dockerfile:3 DL3008 warning: Pin versions in apt get install. Instead of ` + "`apt-get install <package>`" + ` use ` + "`apt-get install <package>=<version>`" + `
+Dockerfile:3 DL3009 info: Delete the apt-get lists after installing something
+`
+
+	if got, err := lintResult(findings, 0, "Dockerfile", "error"); err != nil || got != findings {
+		t.Errorf("lintResult() below the threshold = %q, %v, want the findings and no error", got, err)
+	}
+
+	got, err := lintResult(findings, 1, "Dockerfile", "warning")
+	if err == nil {
+		t.Fatal("lintResult() with a failing exit code succeeded, want an error")
+	}
+
+	if got != findings || !strings.Contains(err.Error(), "DL3008") || !strings.Contains(err.Error(), "warning severity") {
+		t.Errorf("lintResult() = %q, %v, want the findings in the error", got, err)
+	}
+}
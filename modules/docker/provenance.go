@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"dagger/docker/internal/dagger"
+)
+
+const (
+	dockerfileName = "Dockerfile"
+	redactedValue  = "[REDACTED]"
+)
+
+// sensitiveArgMarkers are substrings of build arg names whose values are redacted in provenance
+var sensitiveArgMarkers = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+type provenance struct {
+	BuildType    string            `json:"buildType"`
+	BuiltAt      string            `json:"builtAt"`
+	Repository   string            `json:"repository"`
+	Environment  string            `json:"environment,omitempty"`
+	SourceCommit string            `json:"sourceCommit,omitempty"`
+	BaseImages   []provenanceImage `json:"baseImages"`
+	BuildArgs    map[string]string `json:"buildArgs"`
+	ImageDigest  string            `json:"imageDigest"`
+}
+
+type provenanceImage struct {
+	Ref    string `json:"ref"`
+	Digest string `json:"digest,omitempty"`
+}
+
+type ociIndex struct {
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// Provenance returns a JSON document describing how the built image was produced, including
+// base images, build arguments (with sensitive values redacted), source commit and image digest
+func (m *Docker) Provenance(ctx context.Context) (*dagger.File, error) {
+	if m.Container == nil {
+		return nil, fmt.Errorf("container is not built yet")
+	}
+
+	digest, err := m.imageDigest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	baseImages, err := m.baseImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := provenanceDocument(provenance{
+		BuildType:    "dagger/docker",
+		BuiltAt:      time.Now().UTC().Format(time.RFC3339),
+		Repository:   m.RepoName,
+		Environment:  m.Environment,
+		SourceCommit: m.sourceCommit(ctx),
+		BaseImages:   baseImages,
+		ImageDigest:  digest,
+	}, m.BuildArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Directory().
+		WithNewFile("provenance.json", contents).
+		File("provenance.json"), nil
+}
+
+// imageDigest returns the manifest digest of the built container exported as an OCI image
+func (m *Docker) imageDigest(ctx context.Context) (string, error) {
+	index, err := dag.Container().
+		From("alpine:latest").
+		WithMountedFile("/image.tar", m.ociTarball()).
+		WithExec([]string{"tar", "-xOf", "/image.tar", "index.json"}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	return parseImageDigest(index)
+}
+
+// provenanceDocument encodes the provenance with the build args added, redacting sensitive values
+func provenanceDocument(doc provenance, buildArgs []string) (string, error) {
+	doc.BuildArgs = make(map[string]string)
+	for _, arg := range parseBuildArgs(buildArgs) {
+		if isSensitiveArg(arg.Name) {
+			doc.BuildArgs[arg.Name] = redactedValue
+		} else {
+			doc.BuildArgs[arg.Name] = arg.Value
+		}
+	}
+
+	contents, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode provenance: %w", err)
+	}
+
+	return string(contents), nil
+}
+
+// parseImageDigest returns the digest of the first manifest in an OCI image index
+func parseImageDigest(index string) (string, error) {
+	var idx ociIndex
+	if err := json.Unmarshal([]byte(index), &idx); err != nil {
+		return "", fmt.Errorf("failed to parse image index: %w", err)
+	}
+
+	if len(idx.Manifests) == 0 {
+		return "", fmt.Errorf("image index contains no manifests")
+	}
+
+	return idx.Manifests[0].Digest, nil
+}
+
+// baseImages resolves the digests of the external images referenced by FROM instructions in the
+// Dockerfile. Containers not built from a Dockerfile, e.g. with BuildContainer, have no base images
+func (m *Docker) baseImages(ctx context.Context) ([]provenanceImage, error) {
+	path := m.Dockerfile
+	if path == "" {
+		path = dockerfileName
+	}
+
+	images := make([]provenanceImage, 0)
+
+	exists, err := m.Source.Exists(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for %s: %w", path, err)
+	}
+
+	if !exists {
+		return images, nil
+	}
+
+	dockerfile, err := m.Source.File(path).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	for _, ref := range parseBaseImages(dockerfile) {
+		image := provenanceImage{Ref: ref}
+
+		// Image references using unresolved ARGs can't be pulled, so record them without a digest
+		if !strings.Contains(ref, "$") {
+			resolved, err := dag.Container().From(ref).ImageRef(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve base image %s: %w", ref, err)
+			}
+
+			if _, digest, ok := strings.Cut(resolved, "@"); ok {
+				image.Digest = digest
+			}
+		}
+
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// sourceCommit returns the commit the source directory is checked out at, or an empty string if unavailable
+func (m *Docker) sourceCommit(ctx context.Context) string {
+	return m.sourceGit(ctx, "rev-parse", "HEAD")
+}
+
+// sourceGit runs a git command in the source directory and returns its trimmed output, or an empty
+// string if it fails, e.g. when the source isn't a git checkout
+func (m *Docker) sourceGit(ctx context.Context, args ...string) string {
+	out, err := dag.Container().
+		From("alpine/git:latest").
+		WithMountedDirectory("/src", m.Source).
+		WithWorkdir("/src").
+		WithExec(append([]string{"git", "-c", "safe.directory=*"}, args...)).
+		Stdout(ctx)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(out)
+}
+
+// parseBaseImages returns the external image references used by FROM instructions, excluding
+// references to earlier build stages and scratch
+func parseBaseImages(dockerfile string) []string {
+	stages := make(map[string]bool)
+	images := make([]string, 0)
+
+	for _, line := range strings.Split(dockerfile, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// Skip flags such as --platform=linux/amd64
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		ref := fields[0]
+		if ref != "scratch" && !stages[strings.ToLower(ref)] {
+			images = append(images, ref)
+		}
+
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+	}
+
+	return images
+}
+
+// isSensitiveArg reports whether a build arg name looks like it holds a secret
+func isSensitiveArg(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, marker := range sensitiveArgMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseBaseImages(t *testing.T) {
+	dockerfile := `# syntax=docker/dockerfile:1
+ARG NODE_VERSION=20
+FROM --platform=linux/amd64 node:${NODE_VERSION}-alpine AS deps
+RUN npm ci
+
+from golang:1.25 as Build
+RUN go build ./...
+
+FROM build AS test
+FROM deps
+FROM scratch
+COPY --from=build /app /app
+FROM gcr.io/distroless/static@sha256:abc123
+`
+
+	got := parseBaseImages(dockerfile)
+	want := []string{"node:${NODE_VERSION}-alpine", "golang:1.25", "gcr.io/distroless/static@sha256:abc123"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("parseBaseImages() = %q, want %q", got, want)
+	}
+}
+
+func TestIsSensitiveArg(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"NPM_TOKEN", true},
+		{"db_password", true},
+		{"API_KEY", true},
+		{"GITHUB_AUTH", true},
+		{"AWS_SECRET_ACCESS_KEY", true},
+		{"NODE_ENV", false},
+		{"VERSION", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSensitiveArg(tt.name); got != tt.want {
+				t.Errorf("isSensitiveArg() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvenanceDocument(t *testing.T) {
+	contents, err := provenanceDocument(provenance{
+		BuildType:   "dagger/docker",
+		BuiltAt:     "2026-10-14T12:00:00Z",
+		Repository:  "mocbot",
+		BaseImages:  []provenanceImage{{Ref: "node:20-alpine", Digest: "sha256:def456"}},
+		ImageDigest: "sha256:abc123",
+	}, []string{"NODE_ENV=production", "NPM_TOKEN=npm_secret", "db_password=hunter2"})
+	if err != nil {
+		t.Fatalf("provenanceDocument() error = %v", err)
+	}
+
+	for _, secret := range []string{"npm_secret", "hunter2"} {
+		if strings.Contains(contents, secret) {
+			t.Errorf("provenanceDocument() contains the secret %q:\n%s", secret, contents)
+		}
+	}
+
+	var got provenance
+	if err := json.Unmarshal([]byte(contents), &got); err != nil {
+		t.Fatalf("failed to decode provenance: %v", err)
+	}
+
+	if got.ImageDigest != "sha256:abc123" {
+		t.Errorf("imageDigest = %q, want %q", got.ImageDigest, "sha256:abc123")
+	}
+
+	if got.Environment != "" || strings.Contains(contents, "environment") {
+		t.Errorf("provenanceDocument() included an empty environment:\n%s", contents)
+	}
+
+	wantArgs := map[string]string{"NODE_ENV": "production", "NPM_TOKEN": redactedValue, "db_password": redactedValue}
+	if !maps.Equal(got.BuildArgs, wantArgs) {
+		t.Errorf("buildArgs = %v, want %v", got.BuildArgs, wantArgs)
+	}
+
+	if !slices.Equal(got.BaseImages, []provenanceImage{{Ref: "node:20-alpine", Digest: "sha256:def456"}}) {
+		t.Errorf("baseImages = %v, want the node image", got.BaseImages)
+	}
+}
+
+func TestParseImageDigest(t *testing.T) {
+	tests := []struct {
+		name    string
+		index   string
+		want    string
+		wantErr bool
+	}{
+		{"first manifest", `{"schemaVersion":2,"manifests":[{"digest":"sha256:abc123"},{"digest":"sha256:def456"}]}`, "sha256:abc123", false},
+		{"no manifests", `{"schemaVersion":2,"manifests":[]}`, "", true},
+		{"invalid JSON", `not json`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImageDigest(tt.index)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseImageDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("parseImageDigest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
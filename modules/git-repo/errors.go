@@ -3,3 +3,11 @@ package main
 import "fmt"
 
 var ErrVersionBumpSkipped = fmt.Errorf("version bump skipped due to [skip] marker in commit message")
+
+var ErrShallowClone = fmt.Errorf("repository is a shallow clone, fetch the full history (e.g. fetch-depth: 0) or use the unshallow policy")
+
+var ErrNoPrerelease = fmt.Errorf("no unreleased prerelease tag found to promote")
+
+var ErrDirtyWorkingTree = fmt.Errorf("working tree has uncommitted changes, commit them or set allowDirty")
+
+var ErrNoBaseRef = fmt.Errorf("no base ref given, found in the CI environment or set as the remote default branch (origin/HEAD)")
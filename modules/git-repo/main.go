@@ -6,7 +6,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,11 +17,28 @@ import (
 	"dagger/git-repo/internal/dagger"
 )
 
+// conventionalCommitPattern matches Conventional Commits subjects, e.g. "feat(api)!: add endpoint"
+const conventionalCommitPattern = `^(build|chore|ci|docs|feat|fix|perf|refactor|revert|style|test)(\([\w\-./ ]+\))?!?: .+`
+
 const ghHost = "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
 
+// baseRefEnvVars are the CI variables holding a pull request's target branch, in order of precedence
+var baseRefEnvVars = []string{
+	"GITHUB_BASE_REF",
+	"CI_MERGE_REQUEST_TARGET_BRANCH_NAME",
+	"BITBUCKET_PR_DESTINATION_BRANCH",
+	"SYSTEM_PULLREQUEST_TARGETBRANCH",
+}
+
 type GitRepo struct {
+	// +private
+	CiEnv []string
 	// +private
 	Ctr *dagger.Container
+	// +private
+	ShallowPolicy ShallowPolicy
+	// +private
+	TagPrefix string
 }
 
 // BumpType represents the type of version bump
@@ -32,86 +51,210 @@ const (
 	BumpMajor BumpType = "major"
 )
 
+// ShallowPolicy determines how shallow clones are handled before analysing history
+type ShallowPolicy string
+
+const (
+	ShallowUnshallow ShallowPolicy = "unshallow"
+	ShallowError     ShallowPolicy = "error"
+	ShallowIgnore    ShallowPolicy = "ignore"
+)
+
+// CommitConvention determines how commit messages are analysed for the version bump
+type CommitConvention string
+
+const (
+	ConventionMarkers      CommitConvention = "markers"
+	ConventionConventional CommitConvention = "conventional"
+)
+
+// conventionalBumpPattern captures the type, scope and breaking marker of a Conventional Commits subject
+var conventionalBumpPattern = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!)?: `)
+
 func New(
 	// The source code directory of the Git repository
 	// +defaultPath="."
 	source *dagger.Directory,
 	// The SSH socket for authenticating with the Git repository
 	ssh *dagger.Socket,
-) *GitRepo {
+	// How to handle a shallow clone: "unshallow" fetches the full history, "error" fails
+	// asking for a deeper clone, "ignore" uses the history as-is
+	// +default="unshallow"
+	shallowPolicy ShallowPolicy,
+	// Prefix for versioning one package of a monorepo, e.g. "web" reads and writes tags like web-v1.2.3
+	// +optional
+	tagPrefix string,
+	// CI environment variables in KEY=VALUE format to detect the base ref of diff-based checks from,
+	// as the host environment isn't visible to modules (e.g. GITHUB_BASE_REF=$GITHUB_BASE_REF)
+	// +optional
+	ciEnv []string,
+	// Name to create tags and commits as
+	// +default="Dagger CI"
+	gitUserName string,
+	// Email to create tags and commits as
+	// +default="masterofcubesau@gmail.com"
+	gitUserEmail string,
+	// Additional known_hosts lines trusted alongside GitHub's host key, e.g. for a self-hosted Gitea
+	// (see ssh-keyscan)
+	// +optional
+	knownHosts []string,
+	// Host whose https:// remote URLs are rewritten to SSH so pushes use the SSH socket
+	// +default="github.com"
+	sshHost string,
+) (*GitRepo, error) {
+	switch shallowPolicy {
+	case ShallowUnshallow, ShallowError, ShallowIgnore:
+	default:
+		return nil, fmt.Errorf("invalid shallow policy: %s", shallowPolicy)
+	}
+
+	if sshHost == "" || strings.ContainsAny(sshHost, "/@ ") {
+		return nil, fmt.Errorf("invalid ssh host: %q", sshHost)
+	}
+
 	ctr := dag.Container().
 		From("alpine/git:latest").
-		WithNewFile("/root/.ssh/known_hosts", ghHost).
+		WithNewFile("/root/.ssh/known_hosts", strings.Join(append([]string{ghHost}, knownHosts...), "\n")+"\n").
 		WithEnvVariable("SSH_AUTH_SOCK", "/var/ssh.sock").
 		WithUnixSocket("/var/ssh.sock", ssh).
-		WithExec([]string{"git", "config", "--global", "user.name", "Dagger CI"}).
-		WithExec([]string{"git", "config", "--global", "user.email", "masterofcubesau@gmail.com"}).
-		WithExec([]string{"git", "config", "--global", "url.ssh://git@github.com/.insteadOf", "https://github.com/"}).
+		WithExec([]string{"git", "config", "--global", "user.name", gitUserName}).
+		WithExec([]string{"git", "config", "--global", "user.email", gitUserEmail}).
+		WithExec([]string{"git", "config", "--global", "url.ssh://git@" + sshHost + "/.insteadOf", "https://" + sshHost + "/"}).
 		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
 		WithMountedDirectory("/repo", source).
 		WithWorkdir("/repo")
 
 	return &GitRepo{
-		Ctr: ctr,
-	}
+		CiEnv:         ciEnv,
+		Ctr:           ctr,
+		ShallowPolicy: shallowPolicy,
+		TagPrefix:     tagPrefix,
+	}, nil
 }
 
 // GetNextVersion determines the next semantic version from the git repository
-// and returns it as a string (e.g., "v1.2.3").
-// By default, it will analyse the most recent commit messages for version bump markers, for instance:
+// and returns it as a string (e.g., "v1.2.3") without the tag prefix.
+// By default, it will analyse every commit since the latest version tag (or the full history when
+// there are no tags) for version bump markers, using the highest bump found, for instance:
 //   - [major] in commit message -> major version bump (v1.0.0 -> v2.0.0)
 //   - [minor] in commit message -> minor version bump (v1.0.0 -> v1.1.0)
 //   - [patch] in commit message -> patch version bump (v1.0.0 -> v1.0.1)
-//   - [skip] in commit message -> no version bump (v1.0.0 -> v1.0.0)
+//   - [skip] in commit message -> commit is left out, no version bump if every commit is skipped
 //   - default (no marker) -> minor version bump (v1.0.0 -> v1.1.0)
+//
+// With the conventional commit convention the markers are ignored and Conventional Commits are used:
+//   - feat!: or a BREAKING CHANGE: footer -> major version bump
+//   - feat: -> minor version bump
+//   - fix: -> patch version bump
+//   - default (no feat or fix commits) -> minor version bump
 func (m *GitRepo) GetNextVersion(
 	ctx context.Context,
 	// Optionally force a specific bump type
 	// +optional
 	forceBump string,
+	// Version to bump from when no tags exist yet
+	// +default="v0.0.0"
+	initialVersion string,
+	// Release the initial version as-is instead of bumping it when no tags exist yet
+	// +optional
+	firstRelease bool,
+	// Analyse commits after this ref instead of since the latest version tag
+	// +optional
+	fromRef string,
+	// Last commit to analyse, defaults to HEAD
+	// +optional
+	toRef string,
+	// Consider prerelease tags (e.g. v1.2.0-rc.1) when finding the latest version to bump from
+	// +optional
+	includePrerelease bool,
+	// How commit messages are analysed: "markers" looks for [major]/[minor]/[patch]/[skip],
+	// "conventional" uses Conventional Commits types
+	// +default="markers"
+	commitConvention CommitConvention,
 ) (string, error) {
-	latestTag, err := m.Ctr.
-		WithExec([]string{"git", "fetch", "--tags"}).
-		WithExec([]string{"git", "tag", "-l", "--sort=-version:refname"}).
-		Stdout(ctx)
+	switch commitConvention {
+	case ConventionMarkers, ConventionConventional:
+	default:
+		return "", fmt.Errorf("invalid commit convention: %s", commitConvention)
+	}
 
-	if err != nil || strings.TrimSpace(latestTag) == "" {
-		// No tags exist, start with v0.0.0
-		latestTag = "v0.0.0"
-	} else {
-		// Get the first line (latest version)
-		lines := strings.Split(strings.TrimSpace(latestTag), "\n")
-		if len(lines) > 0 {
-			latestTag = strings.TrimSpace(lines[0])
-		} else {
-			latestTag = "v0.0.0"
-		}
+	if initialVersion == "" {
+		initialVersion = "v0.0.0"
 	}
 
-	major, minor, patch, err := parseVersion(latestTag)
+	if _, _, _, err := parseVersion(initialVersion); err != nil {
+		return "", fmt.Errorf("invalid initial version %s: expected vMAJOR.MINOR.PATCH: %w", initialVersion, err)
+	}
+
+	ctr, err := m.withFullHistory(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse version %s: %w", latestTag, err)
+		return "", err
+	}
+
+	tags, err := ctr.
+		WithExec([]string{"git", "fetch", "--tags"}).
+		WithExec(m.tagListArgs()).
+		Stdout(ctx)
+
+	latest, found := latestVersion(parseTags(tags, m.tagPrefix()), includePrerelease)
+	noTags := err != nil || !found
+
+	// Bump markers aren't always on the tip commit, so every commit since the latest tag is analysed
+	if fromRef == "" && !noTags {
+		fromRef = latest.Tag
 	}
 
 	// Determine bump type
 	bumpType := BumpMinor // default
 	if forceBump != "" {
 		bumpType = BumpType(forceBump)
-	} else {
-		commitMsg, err := m.Ctr.
-			WithExec([]string{"git", "log", "HEAD", "--pretty=format:%s", "-1"}).
+	} else if commitConvention == ConventionConventional {
+		// Footers are in the body, so full messages are read, separated by NUL bytes
+		commitMsg, err := ctr.
+			WithExec(commitLogArgs(fromRef, toRef, "--pretty=format:%B%x00")).
 			Stdout(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to read commits to analyse: %w", err)
+		}
 
-		if err == nil {
-			bumpType = determineBumpType(commitMsg)
+		bumpType = determineConventionalBumpType(commitMsg)
+	} else {
+		commitMsg, err := ctr.
+			WithExec(commitLogArgs(fromRef, toRef, "--pretty=format:%s%n%b%x00")).
+			Stdout(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to read commits to analyse: %w", err)
 		}
+
+		bumpType = determineBumpType(commitMsg)
 	}
 
+	return nextVersion(latest, noTags, initialVersion, firstRelease, bumpType)
+}
+
+// nextVersion applies the bump to the latest version, or to the initial version when no version tags
+// exist. A first release returns the initial version unchanged
+func nextVersion(latest semver, noTags bool, initialVersion string, firstRelease bool, bumpType BumpType) (string, error) {
 	if bumpType == BumpSkip {
 		// No version bump
 		return "", ErrVersionBumpSkipped
 	}
 
+	major, minor, patch := latest.Major, latest.Minor, latest.Patch
+
+	// When no version tags exist bumps start from the initial version
+	if noTags {
+		if firstRelease {
+			return initialVersion, nil
+		}
+
+		var err error
+		major, minor, patch, err = parseVersion(initialVersion)
+		if err != nil {
+			return "", fmt.Errorf("invalid initial version %s: expected vMAJOR.MINOR.PATCH: %w", initialVersion, err)
+		}
+	}
+
 	switch bumpType {
 	case BumpMajor:
 		major++
@@ -127,24 +270,130 @@ func (m *GitRepo) GetNextVersion(
 	return fmt.Sprintf("v%d.%d.%d", major, minor, patch), nil
 }
 
+// GetLatestTag returns the highest released semantic version tag, or v0.0.0 when there are none.
+// Prerelease and non-semver tags (e.g. latest, nightly) are ignored. Tags keep the tag prefix
+func (m *GitRepo) GetLatestTag(ctx context.Context) (string, error) {
+	tags, err := m.Ctr.
+		WithExec([]string{"git", "fetch", "--tags"}).
+		WithExec(m.tagListArgs()).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	latest, found := latestVersion(parseTags(tags, m.tagPrefix()), false)
+	if !found {
+		return m.tagPrefix() + "v0.0.0", nil
+	}
+
+	return latest.Tag, nil
+}
+
 // TagAndPush creates a new semantic version tag and pushes it to the remote repository
-// Returns the version tag that was created and pushed
+// Returns the version tag that was created and pushed, including the tag prefix
 func (m *GitRepo) TagAndPush(
 	ctx context.Context,
-	// New version to tag, otherwise determined automatically
+	// New version to tag (e.g. v1.2.3) without the tag prefix, otherwise determined automatically
 	// +optional
 	version string,
 	// Optionally force a specific bump type if version is not provided
 	// +optional
 	forceBump string,
+	// Version to bump from when no tags exist yet, if version is not provided
+	// +default="v0.0.0"
+	initialVersion string,
+	// Release the initial version as-is when no tags exist yet, if version is not provided
+	// +optional
+	firstRelease bool,
+	// Analyse commits after this ref instead of since the latest version tag, if version is not provided
+	// +optional
+	fromRef string,
+	// Last commit to analyse if version is not provided, defaults to HEAD
+	// +optional
+	toRef string,
+	// Consider prerelease tags when finding the latest version, if version is not provided
+	// +optional
+	includePrerelease bool,
+	// How commit messages are analysed if version is not provided: "markers" or "conventional"
+	// +default="markers"
+	commitConvention CommitConvention,
+	// Allow tagging when the working tree has uncommitted changes
+	// +optional
+	allowDirty bool,
 	// Optional release message for the tag
 	// +optional
 	message string,
+	// Sign the tag, verifying the signature before pushing
+	// +optional
+	sign bool,
+	// Private key to sign the tag with, without a passphrase. Required when signing
+	// +optional
+	signingKey *dagger.Secret,
+	// Signature format of the signing key: "ssh" or "openpgp"
+	// +default="ssh"
+	signingFormat string,
+	// Print the tag and message that would be created and return the tag without tagging or pushing
+	// +optional
+	dryRun bool,
 ) (string, error) {
+	return m.tagAndPush(ctx, tagOpts{
+		version:           version,
+		forceBump:         forceBump,
+		initialVersion:    initialVersion,
+		firstRelease:      firstRelease,
+		fromRef:           fromRef,
+		toRef:             toRef,
+		includePrerelease: includePrerelease,
+		commitConvention:  commitConvention,
+		allowDirty:        allowDirty,
+		message:           message,
+		sign:              sign,
+		signingKey:        signingKey,
+		signingFormat:     signingFormat,
+		dryRun:            dryRun,
+	})
+}
+
+// tagOpts configures tagAndPush, mirroring the TagAndPush arguments
+type tagOpts struct {
+	version           string
+	forceBump         string
+	initialVersion    string
+	firstRelease      bool
+	fromRef           string
+	toRef             string
+	includePrerelease bool
+	commitConvention  CommitConvention
+	allowDirty        bool
+	message           string
+	sign              bool
+	signingKey        *dagger.Secret
+	signingFormat     string
+	dryRun            bool
+}
+
+// tagAndPush creates and pushes the version tag, determining the next version when none is given
+func (m *GitRepo) tagAndPush(ctx context.Context, opts tagOpts) (string, error) {
+	if opts.sign && opts.signingKey == nil {
+		return "", fmt.Errorf("a signing key is required to sign the tag")
+	}
+
+	// A dry run only previews the tag, so a dirty tree is reported rather than refused
+	if !opts.allowDirty {
+		if err := m.checkClean(ctx); err != nil {
+			if !opts.dryRun {
+				return "", err
+			}
+
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+
 	// Determine version if not provided
+	version := opts.version
 	if version == "" {
 		var err error
-		version, err = m.GetNextVersion(ctx, forceBump)
+		version, err = m.GetNextVersion(ctx, opts.forceBump, opts.initialVersion, opts.firstRelease, opts.fromRef, opts.toRef, opts.includePrerelease, opts.commitConvention)
 		if err == ErrVersionBumpSkipped {
 			return "", nil // No tag created
 		}
@@ -154,21 +403,633 @@ func (m *GitRepo) TagAndPush(
 		}
 	}
 
+	tag := m.tagPrefix() + version
+	message := opts.message
 	if message == "" {
-		message = fmt.Sprintf("Release %s", version)
+		message = fmt.Sprintf("Release %s", tag)
+	}
+
+	if opts.dryRun {
+		fmt.Fprintf(os.Stderr, "dry run: would create and push tag %s with message %q\n", tag, message)
+		return tag, nil
+	}
+
+	ctr := m.Ctr
+	tagFlag := "-a"
+
+	if opts.sign {
+		var err error
+		ctr, err = withSigningKey(ctr, opts.signingKey, opts.signingFormat)
+		if err != nil {
+			return "", err
+		}
+
+		tagFlag = "-s"
+	}
+
+	ctr = ctr.WithExec([]string{"git", "tag", tagFlag, tag, "-m", message})
+
+	if opts.sign {
+		_, err := ctr.
+			WithExec([]string{"git", "verify-tag", tag}).
+			Sync(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to verify the signature of tag %s: %w", tag, err)
+		}
 	}
 
 	// Create and push the tag in a single pipeline
-	_, err := m.Ctr.
-		WithExec([]string{"git", "tag", "-a", version, "-m", message}).
-		WithExec([]string{"git", "push", "origin", version}).
+	_, err := ctr.
+		WithExec([]string{"git", "push", "origin", tag}).
 		Sync(ctx)
 
 	if err != nil {
 		return "", fmt.Errorf("failed to create and push tag: %w", err)
 	}
 
-	return version, nil
+	return tag, nil
+}
+
+// withSigningKey configures git to sign with the key. SSH keys are trusted for the committer email
+// through an allowed signers file, so the tag signature can be verified before pushing
+func withSigningKey(ctr *dagger.Container, signingKey *dagger.Secret, format string) (*dagger.Container, error) {
+	switch format {
+	case "ssh":
+		return ctr.
+			WithMountedSecret("/root/.ssh/signing_key", signingKey, dagger.ContainerWithMountedSecretOpts{Mode: 0o600}).
+			WithExec([]string{"sh", "-c", `echo "$(git config user.email) namespaces=\"git\" $(ssh-keygen -y -f /root/.ssh/signing_key)" > /root/.ssh/allowed_signers`}).
+			WithExec([]string{"git", "config", "--global", "gpg.format", "ssh"}).
+			WithExec([]string{"git", "config", "--global", "user.signingkey", "/root/.ssh/signing_key"}).
+			WithExec([]string{"git", "config", "--global", "gpg.ssh.allowedSignersFile", "/root/.ssh/allowed_signers"}), nil
+	case "openpgp":
+		return ctr.
+			WithExec([]string{"apk", "add", "--no-cache", "gnupg"}).
+			WithMountedSecret("/tmp/signing-key.asc", signingKey).
+			WithExec([]string{"gpg", "--batch", "--import", "/tmp/signing-key.asc"}).
+			WithExec([]string{"sh", "-c", `git config --global user.signingkey "$(gpg --list-secret-keys --with-colons | awk -F: '/^fpr/ { print $10; exit }')"`}).
+			WithExec([]string{"git", "config", "--global", "gpg.format", "openpgp"}), nil
+	default:
+		return nil, fmt.Errorf("invalid signing format: %s", format)
+	}
+}
+
+// CreateRelease creates a GitHub release for an existing version tag with the given notes, e.g. from
+// Changelog, returning the release URL. The repository is taken from the origin remote
+func (m *GitRepo) CreateRelease(
+	ctx context.Context,
+	// Version of the tag to release (e.g. v1.2.3) without the tag prefix
+	version string,
+	// Markdown release notes
+	// +optional
+	notes string,
+	// GitHub token with permission to create releases
+	token *dagger.Secret,
+) (string, error) {
+	remote, err := m.Ctr.
+		WithExec([]string{"git", "remote", "get-url", "origin"}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read origin remote: %w", err)
+	}
+
+	repo, err := parseGitHubRepo(strings.TrimSpace(remote))
+	if err != nil {
+		return "", err
+	}
+
+	tag := m.tagPrefix() + version
+	body, err := json.Marshal(map[string]string{"tag_name": tag, "name": tag, "body": notes})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode release: %w", err)
+	}
+
+	// Creating a release is external state, so the cache is busted to always run the request
+	out, err := dag.Container().
+		From("curlimages/curl:latest").
+		WithSecretVariable("GITHUB_TOKEN", token).
+		WithNewFile("/tmp/release.json", string(body)).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", `curl -sS --fail-with-body -X POST \
+  -H "Authorization: Bearer $GITHUB_TOKEN" \
+  -H "Accept: application/vnd.github+json" \
+  -d @/tmp/release.json \
+  "https://api.github.com/repos/$0/releases"`, repo}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create release %s in %s: %w", tag, repo, err)
+	}
+
+	var release struct {
+		HTMLURL string `json:"html_url"`
+	}
+
+	if err := json.Unmarshal([]byte(out), &release); err != nil {
+		return "", fmt.Errorf("failed to parse release response: %w", err)
+	}
+
+	return release.HTMLURL, nil
+}
+
+// parseGitHubRepo returns the owner/repo of a GitHub remote URL in SSH, scp-like or HTTPS form
+func parseGitHubRepo(remote string) (string, error) {
+	repo := ""
+	for _, prefix := range []string{"git@github.com:", "ssh://git@github.com/", "https://github.com/", "http://github.com/"} {
+		if rest, ok := strings.CutPrefix(remote, prefix); ok {
+			repo = strings.TrimSuffix(strings.TrimSuffix(rest, "/"), ".git")
+			break
+		}
+	}
+
+	if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("origin remote %s is not a GitHub repository", remote)
+	}
+
+	return repo, nil
+}
+
+// checkClean returns an error listing the changed files if the working tree has uncommitted changes
+func (m *GitRepo) checkClean(ctx context.Context) error {
+	status, err := m.Ctr.
+		WithExec([]string{"git", "status", "--porcelain"}).
+		Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check working tree status: %w", err)
+	}
+
+	return dirtyTreeError(status)
+}
+
+// dirtyTreeError returns ErrDirtyWorkingTree with the changed files from git status --porcelain, or
+// nil when nothing changed
+func dirtyTreeError(status string) error {
+	if status = strings.TrimRight(status, "\n"); status != "" {
+		return fmt.Errorf("%w:\n%s", ErrDirtyWorkingTree, status)
+	}
+
+	return nil
+}
+
+// tagPrefix returns the prefix tags carry before the version, e.g. "web-", or an empty string
+func (m *GitRepo) tagPrefix() string {
+	if m.TagPrefix == "" {
+		return ""
+	}
+
+	return m.TagPrefix + "-"
+}
+
+// tagListArgs returns the git tag command listing the tags for the configured prefix
+func (m *GitRepo) tagListArgs() []string {
+	if m.TagPrefix == "" {
+		return []string{"git", "tag", "-l"}
+	}
+
+	return []string{"git", "tag", "-l", m.tagPrefix() + "v*"}
+}
+
+// commitLogArgs returns the git log command for the commits to analyse. With no fromRef the full
+// history up to toRef is used, otherwise the range fromRef..toRef is used verbatim
+func commitLogArgs(fromRef, toRef string, format string) []string {
+	if toRef == "" {
+		toRef = "HEAD"
+	}
+
+	if fromRef == "" {
+		return []string{"git", "log", toRef, format}
+	}
+
+	return []string{"git", "log", fromRef + ".." + toRef, format}
+}
+
+// resolveBaseRef returns the ref diff-based checks compare against. In order of precedence it is
+// the given baseRef, the pull request target branch from the CI environment (see baseRefEnvVars)
+// fetched from origin, or the remote's default branch
+func (m *GitRepo) resolveBaseRef(ctx context.Context, ctr *dagger.Container, baseRef string) (*dagger.Container, string, error) {
+	if baseRef != "" {
+		return ctr, baseRef, nil
+	}
+
+	// CI checkouts often only fetch the pull request ref, so the target branch is fetched explicitly
+	if branch := envBaseBranch(m.CiEnv); branch != "" {
+		ref := "origin/" + branch
+		return ctr.WithExec([]string{"git", "fetch", "origin", branch + ":refs/remotes/" + ref}), ref, nil
+	}
+
+	head, err := ctr.
+		WithExec([]string{"git", "symbolic-ref", "--short", "refs/remotes/origin/HEAD"}).
+		Stdout(ctx)
+	if err != nil || strings.TrimSpace(head) == "" {
+		return nil, "", ErrNoBaseRef
+	}
+
+	return ctr, strings.TrimSpace(head), nil
+}
+
+// envBaseBranch returns the first non-empty base branch variable in KEY=VALUE environment entries
+func envBaseBranch(env []string) string {
+	values := make(map[string]string)
+	for _, entry := range env {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	for _, name := range baseRefEnvVars {
+		if values[name] != "" {
+			return values[name]
+		}
+	}
+
+	return ""
+}
+
+// withFullHistory returns the repository container with complete history, detecting shallow
+// clones and handling them according to the configured policy
+func (m *GitRepo) withFullHistory(ctx context.Context) (*dagger.Container, error) {
+	if m.ShallowPolicy == ShallowIgnore {
+		return m.Ctr, nil
+	}
+
+	shallow, err := m.Ctr.
+		WithExec([]string{"git", "rev-parse", "--is-shallow-repository"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for shallow clone: %w", err)
+	}
+
+	args, err := shallowArgs(m.ShallowPolicy, shallow)
+	if err != nil {
+		return nil, err
+	}
+
+	if args == nil {
+		return m.Ctr, nil
+	}
+
+	return m.Ctr.WithExec(args), nil
+}
+
+// shallowArgs returns the command fetching the full history given the output of
+// git rev-parse --is-shallow-repository, or nil when the history is already complete or the policy
+// ignores shallow clones
+func shallowArgs(policy ShallowPolicy, isShallow string) ([]string, error) {
+	if policy == ShallowIgnore || strings.TrimSpace(isShallow) != "true" {
+		return nil, nil
+	}
+
+	if policy == ShallowError {
+		return nil, ErrShallowClone
+	}
+
+	return []string{"git", "fetch", "--unshallow", "--tags"}, nil
+}
+
+// Promote graduates the latest unreleased prerelease (e.g. v1.2.0-rc.3) to its final version (v1.2.0),
+// tagging the same commit and pushing it. Returns the final version tag
+func (m *GitRepo) Promote(
+	ctx context.Context,
+	// Fall back to a normal version bump when there is no prerelease to promote
+	// +optional
+	fallbackToBump bool,
+	// Optional release message for the tag
+	// +optional
+	message string,
+) (string, error) {
+	tags, err := m.Ctr.
+		WithExec([]string{"git", "fetch", "--tags"}).
+		WithExec(m.tagListArgs()).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	prerelease, ok := latestUnreleasedPrerelease(parseTags(tags, m.tagPrefix()))
+	if !ok {
+		if fallbackToBump {
+			return m.tagAndPush(ctx, tagOpts{initialVersion: "v0.0.0", commitConvention: ConventionMarkers, message: message})
+		}
+
+		return "", ErrNoPrerelease
+	}
+
+	version := prerelease.Base().String()
+	tag := m.tagPrefix() + version
+	if message == "" {
+		message = fmt.Sprintf("Release %s", tag)
+	}
+
+	_, err = m.Ctr.
+		WithExec([]string{"git", "tag", "-a", tag, prerelease.Tag + "^{commit}", "-m", message}).
+		WithExec([]string{"git", "push", "origin", tag}).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create and push tag: %w", err)
+	}
+
+	return tag, nil
+}
+
+// ValidateCommits checks every commit subject after baseRef matches a pattern, returning an error
+// listing the commits that don't conform
+func (m *GitRepo) ValidateCommits(
+	ctx context.Context,
+	// Regular expression commit subjects must match, defaults to Conventional Commits
+	// +optional
+	pattern string,
+	// Validate commits after this ref up to HEAD, detected from the CI environment or the default
+	// branch when empty
+	// +optional
+	baseRef string,
+) error {
+	if pattern == "" {
+		pattern = conventionalCommitPattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid commit pattern %s: %w", pattern, err)
+	}
+
+	ctr, err := m.withFullHistory(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctr, baseRef, err = m.resolveBaseRef(ctx, ctr, baseRef)
+	if err != nil {
+		return err
+	}
+
+	log, err := ctr.
+		WithExec(commitLogArgs(baseRef, "", "--pretty=format:%h %s")).
+		Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read commits after %s: %w", baseRef, err)
+	}
+
+	if violations := invalidCommits(log, re); len(violations) > 0 {
+		return fmt.Errorf("%d commit(s) do not match %s:\n%s", len(violations), pattern, strings.Join(violations, "\n"))
+	}
+
+	return nil
+}
+
+// invalidCommits returns the "<hash> <subject>" log lines whose subject doesn't match the pattern
+func invalidCommits(log string, re *regexp.Regexp) []string {
+	var violations []string
+
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		if line == "" {
+			continue
+		}
+
+		_, subject, _ := strings.Cut(line, " ")
+		if !re.MatchString(subject) {
+			violations = append(violations, line)
+		}
+	}
+
+	return violations
+}
+
+// VerifySignatures checks every commit after baseRef has a valid GPG or SSH signature from a
+// trusted key, returning an error listing the commits that are unsigned or fail verification
+func (m *GitRepo) VerifySignatures(
+	ctx context.Context,
+	// Verify commits after this ref up to HEAD, detected from the CI environment or the default
+	// branch when empty
+	// +optional
+	baseRef string,
+	// ASCII-armored GPG public keys to trust
+	// +optional
+	gpgKeys *dagger.File,
+	// An SSH allowed signers file (see ssh-keygen ALLOWED SIGNERS) listing the keys to trust
+	// +optional
+	allowedSigners *dagger.File,
+) error {
+	if gpgKeys == nil && allowedSigners == nil {
+		return fmt.Errorf("no trusted keys provided, set gpgKeys and/or allowedSigners")
+	}
+
+	ctr, err := m.withFullHistory(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctr, baseRef, err = m.resolveBaseRef(ctx, ctr, baseRef)
+	if err != nil {
+		return err
+	}
+
+	if gpgKeys != nil {
+		ctr = ctr.
+			WithExec([]string{"apk", "add", "--no-cache", "gnupg"}).
+			WithFile("/tmp/trusted-keys.asc", gpgKeys).
+			WithExec([]string{"gpg", "--batch", "--import", "/tmp/trusted-keys.asc"})
+	}
+
+	if allowedSigners != nil {
+		ctr = ctr.
+			WithFile("/root/.ssh/allowed_signers", allowedSigners).
+			WithExec([]string{"git", "config", "--global", "gpg.ssh.allowedSignersFile", "/root/.ssh/allowed_signers"})
+	}
+
+	log, err := ctr.
+		WithExec(commitLogArgs(baseRef, "", "--pretty=format:%h %G? %s")).
+		Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read commit signatures after %s: %w", baseRef, err)
+	}
+
+	if violations := unverifiedCommits(log); len(violations) > 0 {
+		return fmt.Errorf("%d commit(s) are not signed by a trusted key:\n%s", len(violations), strings.Join(violations, "\n"))
+	}
+
+	return nil
+}
+
+// signatureStatuses describes the git %G? signature statuses that fail verification
+var signatureStatuses = map[string]string{
+	"N": "unsigned",
+	"B": "bad signature",
+	"E": "signed by an unknown key",
+	"X": "expired signature",
+	"Y": "signed by an expired key",
+	"R": "signed by a revoked key",
+}
+
+// unverifiedCommits returns the "<hash> <subject> (<reason>)" entries for "<hash> <status> <subject>"
+// log lines without a good signature. Imported GPG keys have no ownertrust, so good signatures of
+// unknown validity (U) are accepted
+func unverifiedCommits(log string) []string {
+	var violations []string
+
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			continue
+		}
+
+		hash, status := fields[0], fields[1]
+		if status == "G" || status == "U" {
+			continue
+		}
+
+		reason, ok := signatureStatuses[status]
+		if !ok {
+			reason = "unverifiable signature"
+		}
+
+		subject := ""
+		if len(fields) == 3 {
+			subject = fields[2]
+		}
+
+		violations = append(violations, fmt.Sprintf("%s %s (%s)", hash, subject, reason))
+	}
+
+	return violations
+}
+
+// Changelog returns a markdown changelog of the Conventional Commits between two refs, grouped into
+// breaking changes, features and fixes with short commit hashes. Other commit types are left out
+func (m *GitRepo) Changelog(
+	ctx context.Context,
+	// Ref to list commits after, defaults to the latest version tag or the full history without one
+	// +optional
+	from string,
+	// Last commit to include, defaults to HEAD
+	// +optional
+	to string,
+) (string, error) {
+	ctr, err := m.withFullHistory(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if from == "" {
+		tags, err := ctr.
+			WithExec([]string{"git", "fetch", "--tags"}).
+			WithExec(m.tagListArgs()).
+			Stdout(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to list tags: %w", err)
+		}
+
+		if latest, found := latestVersion(parseTags(tags, m.tagPrefix()), false); found {
+			from = latest.Tag
+		}
+	}
+
+	log, err := ctr.
+		WithExec(commitLogArgs(from, to, "--pretty=format:%h%x1f%B%x00")).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read commits: %w", err)
+	}
+
+	return formatChangelog(log), nil
+}
+
+// formatChangelog groups NUL-separated "<hash>\x1f<message>" log entries into markdown sections
+func formatChangelog(log string) string {
+	sections := []struct {
+		title   string
+		entries []string
+	}{
+		{title: "Breaking Changes"},
+		{title: "Features"},
+		{title: "Fixes"},
+	}
+
+	for _, entry := range strings.Split(log, "\x00") {
+		hash, msg, ok := strings.Cut(strings.TrimSpace(entry), "\x1f")
+		if !ok {
+			continue
+		}
+
+		subject, body, _ := strings.Cut(strings.TrimSpace(msg), "\n")
+		matches := conventionalBumpPattern.FindStringSubmatch(subject)
+		if matches == nil {
+			continue
+		}
+
+		description := strings.TrimSpace(subject[len(matches[0]):])
+		if scope := matches[2]; scope != "" {
+			description = fmt.Sprintf("**%s:** %s", scope, description)
+		}
+
+		line := fmt.Sprintf("- %s (%s)", description, hash)
+
+		switch {
+		case matches[3] == "!" || hasBreakingFooter(body):
+			sections[0].entries = append(sections[0].entries, line)
+		case strings.EqualFold(matches[1], "feat"):
+			sections[1].entries = append(sections[1].entries, line)
+		case strings.EqualFold(matches[1], "fix"):
+			sections[2].entries = append(sections[2].entries, line)
+		}
+	}
+
+	var b strings.Builder
+	for _, section := range sections {
+		if len(section.entries) == 0 {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+
+		fmt.Fprintf(&b, "## %s\n\n%s\n", section.title, strings.Join(section.entries, "\n"))
+	}
+
+	return b.String()
+}
+
+// latestVersion returns the highest version, ignoring prereleases unless includePrerelease is set
+func latestVersion(versions []semver, includePrerelease bool) (semver, bool) {
+	var latest semver
+	found := false
+
+	for _, v := range versions {
+		if v.IsPrerelease() && !includePrerelease {
+			continue
+		}
+
+		if !found || v.Compare(latest) > 0 {
+			latest = v
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+// latestUnreleasedPrerelease returns the highest prerelease whose final version hasn't been released yet
+func latestUnreleasedPrerelease(versions []semver) (semver, bool) {
+	released := make(map[string]bool)
+	for _, v := range versions {
+		if !v.IsPrerelease() {
+			released[v.String()] = true
+		}
+	}
+
+	var latest semver
+	found := false
+
+	for _, v := range versions {
+		if !v.IsPrerelease() || released[v.Base().String()] {
+			continue
+		}
+
+		if !found || v.Compare(latest) > 0 {
+			latest = v
+			found = true
+		}
+	}
+
+	return latest, found
 }
 
 // parseVersion parses a semantic version string (e.g., "v1.2.3") into its components
@@ -189,26 +1050,112 @@ func parseVersion(version string) (major, minor, patch int, err error) {
 	return major, minor, patch, nil
 }
 
-// determineBumpType analyses commit messages to determine the appropriate version bump
+// determineBumpType analyses NUL-separated commit messages and returns the highest bump across
+// them. Each commit is classified on its own: [skip] commits are left out and commits without a
+// marker count as minor, so the result is only a skip when every commit is skipped
 func determineBumpType(commitMessages string) BumpType {
-	lowerMessages := strings.ToLower(commitMessages)
+	bump := BumpSkip
+	found := false
 
-	if strings.Contains(lowerMessages, "[skip]") {
-		return BumpSkip
+	for _, msg := range strings.Split(commitMessages, "\x00") {
+		msg = strings.TrimSpace(msg)
+		if msg == "" {
+			continue
+		}
+
+		found = true
+		if commitBump := commitBumpType(msg); bumpRank(commitBump) > bumpRank(bump) {
+			bump = commitBump
+		}
+	}
+
+	if !found {
+		// Default to minor bump
+		return BumpMinor
 	}
 
-	if strings.Contains(lowerMessages, "[major]") {
+	return bump
+}
+
+// commitBumpType returns the bump a single commit message asks for, defaulting to minor
+func commitBumpType(msg string) BumpType {
+	lowerMessage := strings.ToLower(msg)
+
+	switch {
+	case strings.Contains(lowerMessage, "[skip]"):
+		return BumpSkip
+	case strings.Contains(lowerMessage, "[major]"):
 		return BumpMajor
+	case strings.Contains(lowerMessage, "[minor]"):
+		return BumpMinor
+	case strings.Contains(lowerMessage, "[patch]"):
+		return BumpPatch
+	default:
+		return BumpMinor
+	}
+}
+
+// bumpRank orders bump types from skip (lowest) to major (highest)
+func bumpRank(bump BumpType) int {
+	switch bump {
+	case BumpPatch:
+		return 1
+	case BumpMinor:
+		return 2
+	case BumpMajor:
+		return 3
+	default:
+		return 0
 	}
+}
+
+// determineConventionalBumpType analyses NUL-separated Conventional Commits messages to determine the
+// highest version bump, ignoring [major]/[minor]/[patch]/[skip] markers
+func determineConventionalBumpType(commitMessages string) BumpType {
+	var bump BumpType
+
+	for _, msg := range strings.Split(commitMessages, "\x00") {
+		msg = strings.TrimSpace(msg)
+		if msg == "" {
+			continue
+		}
+
+		subject, body, _ := strings.Cut(msg, "\n")
+		matches := conventionalBumpPattern.FindStringSubmatch(subject)
 
-	if strings.Contains(lowerMessages, "[minor]") {
+		if matches != nil && matches[3] == "!" || hasBreakingFooter(body) {
+			return BumpMajor
+		}
+
+		if matches == nil {
+			continue
+		}
+
+		switch strings.ToLower(matches[1]) {
+		case "feat":
+			bump = BumpMinor
+		case "fix":
+			if bump == "" {
+				bump = BumpPatch
+			}
+		}
+	}
+
+	if bump == "" {
+		// Default to minor bump
 		return BumpMinor
 	}
 
-	if strings.Contains(lowerMessages, "[patch]") {
-		return BumpPatch
+	return bump
+}
+
+// hasBreakingFooter reports whether a commit body contains a BREAKING CHANGE footer
+func hasBreakingFooter(body string) bool {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "BREAKING CHANGE:") || strings.HasPrefix(line, "BREAKING-CHANGE:") {
+			return true
+		}
 	}
 
-	// Default to minor bump
-	return BumpMinor
+	return false
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestDetermineBumpType(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     BumpType
+	}{
+		{"no commits", nil, BumpMinor},
+		{"unmarked commit", []string{"add feature"}, BumpMinor},
+		{"patch marker", []string{"[patch] fix typo"}, BumpPatch},
+		{"major marker in body", []string{"rework api\n\n[major]"}, BumpMajor},
+		{"markers are case insensitive", []string{"[PATCH] fix typo"}, BumpPatch},
+		{"highest bump wins", []string{"[patch] fix", "[major] break", "[minor] add"}, BumpMajor},
+		{"unmarked commits outrank patch", []string{"one", "two", "three", "[patch] fix"}, BumpMinor},
+		{"skipped commits are left out", []string{"[skip] docs", "[patch] fix"}, BumpPatch},
+		{"skip only when every commit skips", []string{"[skip] docs", "[skip] ci"}, BumpSkip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := determineBumpType(joinCommits(tt.messages)); got != tt.want {
+				t.Errorf("determineBumpType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// joinCommits formats messages like git log --pretty=format:%s%n%b%x00
+func joinCommits(messages []string) string {
+	var log string
+	for _, msg := range messages {
+		log += msg + "\n\x00"
+	}
+
+	return log
+}
+
+func TestCommitLogArgs(t *testing.T) {
+	tests := []struct {
+		name           string
+		fromRef, toRef string
+		want           []string
+	}{
+		{"full history", "", "", []string{"git", "log", "HEAD", "%s"}},
+		{"full history to ref", "", "release", []string{"git", "log", "release", "%s"}},
+		{"since ref", "v1.0.0", "", []string{"git", "log", "v1.0.0..HEAD", "%s"}},
+		{"explicit range", "v1.0.0", "v1.1.0", []string{"git", "log", "v1.0.0..v1.1.0", "%s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commitLogArgs(tt.fromRef, tt.toRef, "%s"); !slices.Equal(got, tt.want) {
+				t.Errorf("commitLogArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidCommits(t *testing.T) {
+	log := "a1b2c3d feat(api): add endpoint\nb2c3d4e Update readme\nc3d4e5f fix!: drop legacy flag\nd4e5f6a wip\n"
+
+	got := invalidCommits(log, regexp.MustCompile(conventionalCommitPattern))
+	want := []string{"b2c3d4e Update readme", "d4e5f6a wip"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("invalidCommits() = %q, want %q", got, want)
+	}
+
+	if got := invalidCommits("", regexp.MustCompile(conventionalCommitPattern)); len(got) != 0 {
+		t.Errorf("invalidCommits() with no commits = %q, want none", got)
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	tags := "v1.0.0\nv1.2.0\nv1.10.0\nv2.0.0-rc.1\nv1.9.0"
+
+	tests := []struct {
+		name              string
+		tags              string
+		includePrerelease bool
+		want              string
+		wantOk            bool
+	}{
+		{"stable only", tags, false, "v1.10.0", true},
+		{"including prereleases", tags, true, "v2.0.0-rc.1", true},
+		{"only prereleases", "v1.0.0-rc.1", false, "", false},
+		{"no tags", "", false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := latestVersion(parseTags(tt.tags, ""), tt.includePrerelease)
+			if ok != tt.wantOk || got.Tag != tt.want {
+				t.Errorf("latestVersion() = %q, %t, want %q, %t", got.Tag, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestDetermineConventionalBumpType(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     BumpType
+	}{
+		{"fix", []string{"fix: handle nil"}, BumpPatch},
+		{"feat outranks fix", []string{"fix: handle nil", "feat(api): add endpoint", "fix: typo"}, BumpMinor},
+		{"breaking marker", []string{"fix: handle nil", "feat!: drop v1"}, BumpMajor},
+		{"scoped breaking marker", []string{"refactor(core)!: rename types"}, BumpMajor},
+		{"breaking footer", []string{"feat: new config\n\nBREAKING CHANGE: old keys removed"}, BumpMajor},
+		{"markers are ignored", []string{"fix: typo [major]"}, BumpPatch},
+		{"no releasable commits", []string{"chore: bump deps", "docs: readme"}, BumpMinor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := determineConventionalBumpType(joinCommits(tt.messages)); got != tt.want {
+				t.Errorf("determineConventionalBumpType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnverifiedCommits(t *testing.T) {
+	log := "a1b2c3d G feat: signed\nb2c3d4e N fix: unsigned\nc3d4e5f U chore: unknown validity\nd4e5f6a B docs: tampered\ne5f6a7b R ci: revoked key\n"
+
+	got := unverifiedCommits(log)
+	want := []string{
+		"b2c3d4e fix: unsigned (unsigned)",
+		"d4e5f6a docs: tampered (bad signature)",
+		"e5f6a7b ci: revoked key (signed by a revoked key)",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("unverifiedCommits() = %q, want %q", got, want)
+	}
+}
+
+func TestEnvBaseBranch(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{"github", []string{"GITHUB_BASE_REF=main"}, "main"},
+		{"gitlab", []string{"CI_MERGE_REQUEST_TARGET_BRANCH_NAME=develop"}, "develop"},
+		{"precedence", []string{"CI_MERGE_REQUEST_TARGET_BRANCH_NAME=develop", "GITHUB_BASE_REF=main"}, "main"},
+		{"empty values are skipped", []string{"GITHUB_BASE_REF=", "BITBUCKET_PR_DESTINATION_BRANCH=release"}, "release"},
+		{"unrelated variables", []string{"CI=true", "GITHUB_REF_NAME=feature"}, ""},
+		{"no environment", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := envBaseBranch(tt.env); got != tt.want {
+				t.Errorf("envBaseBranch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatChangelog(t *testing.T) {
+	log := "a1b2c3d\x1ffeat(api): add endpoint\n\x00" +
+		"b2c3d4e\x1ffix: handle nil\n\x00" +
+		"c3d4e5f\x1fchore: bump deps\n\x00" +
+		"d4e5f6a\x1ffeat!: drop v1\n\x00" +
+		"e5f6a7b\x1frefactor: new config\n\nBREAKING CHANGE: old keys removed\n\x00"
+
+	want := `## Breaking Changes
+
+- drop v1 (d4e5f6a)
+- new config (e5f6a7b)
+
+## Features
+
+- **api:** add endpoint (a1b2c3d)
+
+## Fixes
+
+- handle nil (b2c3d4e)
+`
+
+	if got := formatChangelog(log); got != want {
+		t.Errorf("formatChangelog() =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := formatChangelog("a1b2c3d\x1fchore: bump deps\n\x00"); got != "" {
+		t.Errorf("formatChangelog() with no releasable commits = %q, want empty", got)
+	}
+}
+
+func TestParseGitHubRepo(t *testing.T) {
+	tests := []struct {
+		remote  string
+		want    string
+		wantErr bool
+	}{
+		{"git@github.com:mocbotau/infra-dagger-modules.git", "mocbotau/infra-dagger-modules", false},
+		{"ssh://git@github.com/mocbotau/infra-dagger-modules.git", "mocbotau/infra-dagger-modules", false},
+		{"https://github.com/mocbotau/infra-dagger-modules", "mocbotau/infra-dagger-modules", false},
+		{"https://github.com/mocbotau/infra-dagger-modules/", "mocbotau/infra-dagger-modules", false},
+		{"git@gitlab.com:mocbotau/infra-dagger-modules.git", "", true},
+		{"https://github.com/mocbotau", "", true},
+		{"https://github.com/mocbotau/infra/extra", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			got, err := parseGitHubRepo(tt.remote)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseGitHubRepo() = %q, %v, want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	latest := semver{Major: 1, Minor: 2, Patch: 3, Tag: "v1.2.3"}
+
+	tests := []struct {
+		name           string
+		noTags         bool
+		initialVersion string
+		firstRelease   bool
+		bump           BumpType
+		want           string
+	}{
+		{"patch", false, "v0.0.0", false, BumpPatch, "v1.2.4"},
+		{"minor", false, "v0.0.0", false, BumpMinor, "v1.3.0"},
+		{"major", false, "v0.0.0", false, BumpMajor, "v2.0.0"},
+		{"first release ignored with tags", false, "v1.0.0", true, BumpMinor, "v1.3.0"},
+		{"bump from initial version", true, "v1.0.0", false, BumpMinor, "v1.1.0"},
+		{"default initial version", true, "v0.0.0", false, BumpPatch, "v0.0.1"},
+		{"first release", true, "v1.0.0", true, BumpMajor, "v1.0.0"},
+		{"first release keeps the initial version as given", true, "1.0.0", true, BumpMinor, "1.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextVersion(latest, tt.noTags, tt.initialVersion, tt.firstRelease, tt.bump)
+			if err != nil || got != tt.want {
+				t.Errorf("nextVersion() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextVersionSkip(t *testing.T) {
+	if _, err := nextVersion(semver{}, true, "v1.0.0", true, BumpSkip); !errors.Is(err, ErrVersionBumpSkipped) {
+		t.Errorf("nextVersion() error = %v, want %v", err, ErrVersionBumpSkipped)
+	}
+}
+
+func TestShallowArgs(t *testing.T) {
+	unshallow := []string{"git", "fetch", "--unshallow", "--tags"}
+
+	tests := []struct {
+		name      string
+		policy    ShallowPolicy
+		isShallow string
+		want      []string
+		wantErr   error
+	}{
+		{"complete history", ShallowUnshallow, "false\n", nil, nil},
+		{"unshallow", ShallowUnshallow, "true\n", unshallow, nil},
+		{"error", ShallowError, "true\n", nil, ErrShallowClone},
+		{"error with complete history", ShallowError, "false\n", nil, nil},
+		{"ignore", ShallowIgnore, "true\n", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := shallowArgs(tt.policy, tt.isShallow)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("shallowArgs() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("shallowArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirtyTreeError(t *testing.T) {
+	if err := dirtyTreeError(""); err != nil {
+		t.Errorf("dirtyTreeError() with a clean tree = %v, want nil", err)
+	}
+
+	err := dirtyTreeError(" M main.go\n?? notes.txt\n")
+	if !errors.Is(err, ErrDirtyWorkingTree) {
+		t.Fatalf("dirtyTreeError() error = %v, want %v", err, ErrDirtyWorkingTree)
+	}
+
+	if want := ErrDirtyWorkingTree.Error() + ":\n M main.go\n?? notes.txt"; err.Error() != want {
+		t.Errorf("dirtyTreeError() = %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// TagAndPushPackages versions each package of a monorepo by its tag prefix, creating and pushing the
+// tags in parallel. Returns the tags that were created, leaving out packages whose bump was skipped
+func (m *GitRepo) TagAndPushPackages(
+	ctx context.Context,
+	// Tag prefixes of the packages to release, e.g. ["web", "api"] for tags like web-v1.2.3
+	prefixes []string,
+	// Version to bump from when a package has no tags yet
+	// +default="v0.0.0"
+	initialVersion string,
+	// How commit messages are analysed: "markers" or "conventional"
+	// +default="markers"
+	commitConvention CommitConvention,
+	// Allow tagging when the working tree has uncommitted changes
+	// +optional
+	allowDirty bool,
+	// Print the tags and messages that would be created and return the tags without tagging or pushing
+	// +optional
+	dryRun bool,
+	// Maximum number of packages tagged and pushed at once, so many packages don't exhaust SSH
+	// connections or the remote's rate limits
+	// +default=4
+	maxConcurrency int,
+) ([]string, error) {
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no package tag prefixes given")
+	}
+
+	if maxConcurrency < 1 {
+		return nil, fmt.Errorf("max concurrency must be at least 1")
+	}
+
+	return tagPackages(prefixes, maxConcurrency, func(prefix string) (string, error) {
+		pkg := *m
+		pkg.TagPrefix = prefix
+
+		return pkg.tagAndPush(ctx, tagOpts{
+			initialVersion:   initialVersion,
+			commitConvention: commitConvention,
+			allowDirty:       allowDirty,
+			dryRun:           dryRun,
+		})
+	})
+}
+
+// tagPackages runs tag for each prefix with at most maxConcurrency running at once. The tags created
+// are returned in the order of the prefixes alongside an error joining every failure, so one failing
+// package doesn't stop the others from being released
+func tagPackages(prefixes []string, maxConcurrency int, tag func(prefix string) (string, error)) ([]string, error) {
+	tags := make([]string, len(prefixes))
+	errs := make([]error, len(prefixes))
+
+	var g errgroup.Group
+	g.SetLimit(maxConcurrency)
+
+	for i, prefix := range prefixes {
+		g.Go(func() error {
+			tags[i], errs[i] = tag(prefix)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", prefix, errs[i])
+			}
+
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+
+	created := make([]string, 0, len(prefixes))
+	for _, tag := range tags {
+		// An empty tag means every commit since the package's last release was skipped
+		if tag != "" {
+			created = append(created, tag)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return created, fmt.Errorf("failed to tag and push %d of %d packages: %w", countErrors(errs), len(prefixes), err)
+	}
+
+	return created, nil
+}
+
+// countErrors returns the number of non-nil errors
+func countErrors(errs []error) int {
+	n := 0
+	for _, err := range errs {
+		if err != nil {
+			n++
+		}
+	}
+
+	return n
+}
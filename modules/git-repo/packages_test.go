@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTagPackagesBoundsConcurrency(t *testing.T) {
+	prefixes := []string{"web", "api", "worker", "docs", "cli", "sdk", "admin", "broken"}
+	const maxConcurrency = 3
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+
+	// The counting stub holds each push open briefly so concurrent calls overlap
+	tag := func(prefix string) (string, error) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		switch prefix {
+		case "broken":
+			return "", errors.New("failed to create and push tag: permission denied")
+		case "docs":
+			// Every commit was skipped, so no tag is created
+			return "", nil
+		}
+
+		return prefix + "-v1.1.0", nil
+	}
+
+	got, err := tagPackages(prefixes, maxConcurrency, tag)
+
+	if peak > maxConcurrency {
+		t.Errorf("tagPackages() ran %d operations at once, want at most %d", peak, maxConcurrency)
+	}
+
+	if peak < 2 {
+		t.Errorf("tagPackages() ran at most %d operation at once, want operations in parallel", peak)
+	}
+
+	want := []string{"web-v1.1.0", "api-v1.1.0", "worker-v1.1.0", "cli-v1.1.0", "sdk-v1.1.0", "admin-v1.1.0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("tagPackages() = %q, want %q", got, want)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "1 of 8 packages") || !strings.Contains(err.Error(), "broken: failed to create and push tag") {
+		t.Errorf("tagPackages() error = %v, want the broken package's failure", err)
+	}
+}
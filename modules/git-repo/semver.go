@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var semverPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// semver is a parsed semantic version tag
+type semver struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+	// Tag is the original string the version was parsed from
+	Tag string
+}
+
+// parseSemver parses a full semantic version string (e.g. "v1.2.3-rc.1") including any prerelease
+func parseSemver(version string) (semver, error) {
+	matches := semverPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return semver{}, fmt.Errorf("invalid version format: %s", version)
+	}
+
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	patch, _ := strconv.Atoi(matches[3])
+
+	return semver{Major: major, Minor: minor, Patch: patch, Prerelease: matches[4], Tag: version}, nil
+}
+
+// String formats the version as a tag, e.g. "v1.2.3-rc.1"
+func (v semver) String() string {
+	s := fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+
+	return s
+}
+
+// IsPrerelease reports whether the version has a prerelease suffix
+func (v semver) IsPrerelease() bool {
+	return v.Prerelease != ""
+}
+
+// Base returns the version without its prerelease suffix
+func (v semver) Base() semver {
+	return semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+}
+
+// Compare returns -1, 0 or 1 if v has lower, equal or higher precedence than other
+func (v semver) Compare(other semver) int {
+	for _, diff := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if diff != 0 {
+			return sign(diff)
+		}
+	}
+
+	// A version without a prerelease has higher precedence than one with
+	switch {
+	case v.Prerelease == other.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case other.Prerelease == "":
+		return -1
+	}
+
+	a := strings.Split(v.Prerelease, ".")
+	b := strings.Split(other.Prerelease, ".")
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := comparePrereleaseIdentifier(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	return sign(len(a) - len(b))
+}
+
+// comparePrereleaseIdentifier compares dot separated prerelease identifiers. Numeric identifiers
+// compare numerically and have lower precedence than alphanumeric ones
+func comparePrereleaseIdentifier(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		return sign(na - nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// parseTags parses the semantic version tags with the given prefix in newline separated tag output,
+// skipping any that aren't valid. Versions keep the full tag in Tag
+func parseTags(output string, prefix string) []semver {
+	versions := make([]semver, 0)
+
+	for _, tag := range strings.Split(output, "\n") {
+		tag = strings.TrimSpace(tag)
+
+		version, ok := strings.CutPrefix(tag, prefix)
+		if !ok {
+			continue
+		}
+
+		v, err := parseSemver(version)
+		if err == nil {
+			v.Tag = tag
+			versions = append(versions, v)
+		}
+	}
+
+	return versions
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "v1.2.4", -1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.2.0", "v1.2.0-rc.1", 1},
+		{"v1.2.0-rc.1", "v1.2.0", -1},
+		{"v1.2.0-rc.2", "v1.2.0-rc.10", -1},
+		{"v1.2.0-alpha", "v1.2.0-beta", -1},
+		{"v1.2.0-1", "v1.2.0-alpha", -1},
+		{"v1.2.0-rc", "v1.2.0-rc.1", -1},
+		{"v1.2.0+build.1", "v1.2.0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			a, err := parseSemver(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := parseSemver(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := a.Compare(b); got != tt.want {
+				t.Errorf("Compare() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSemverInvalid(t *testing.T) {
+	for _, version := range []string{"", "v1.2", "1.2.3.4", "release-1.2.3", "v1.2.3-"} {
+		if _, err := parseSemver(version); err == nil {
+			t.Errorf("parseSemver(%q) succeeded, want an error", version)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	output := "api/v1.0.0\napi/v1.1.0-rc.1\nweb/v2.0.0\nv3.0.0\napi/latest\n"
+
+	versions := parseTags(output, "api/")
+	if len(versions) != 2 {
+		t.Fatalf("parseTags() returned %d versions, want 2", len(versions))
+	}
+
+	if versions[0].Tag != "api/v1.0.0" || versions[1].Tag != "api/v1.1.0-rc.1" {
+		t.Errorf("parseTags() tags = %s, %s, want the full prefixed tags", versions[0].Tag, versions[1].Tag)
+	}
+
+	if versions[1].String() != "v1.1.0-rc.1" {
+		t.Errorf("String() = %s, want v1.1.0-rc.1", versions[1].String())
+	}
+}
+
+func TestLatestUnreleasedPrerelease(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   string
+		want   string
+		wantOk bool
+	}{
+		{"promotes the highest rc", "v1.1.0\nv1.2.0-rc.1\nv1.2.0-rc.3\nv1.2.0-rc.2", "v1.2.0-rc.3", true},
+		{"no prerelease", "v1.0.0\nv1.1.0", "", false},
+		{"prerelease already released", "v1.2.0-rc.1\nv1.2.0", "", false},
+		{"skips released prereleases", "v1.2.0-rc.1\nv1.2.0\nv1.3.0-beta.1", "v1.3.0-beta.1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := latestUnreleasedPrerelease(parseTags(tt.tags, ""))
+			if ok != tt.wantOk || got.Tag != tt.want {
+				t.Errorf("latestUnreleasedPrerelease() = %q, %t, want %q, %t", got.Tag, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -3,8 +3,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"dagger/golang-ci/internal/dagger"
 
@@ -12,11 +19,41 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	caCertPath     = "/usr/local/share/ca-certificates/custom-ca.crt"
+	systemCABundle = "/etc/ssl/certs/ca-certificates.crt"
+	coverProfile   = "/tmp/coverage.out"
+	junitReport    = "/tmp/junit.xml"
+	// testJSONReport holds the go test -json event stream converted into the JUnit report
+	testJSONReport = "/tmp/test.json"
+	// sarifReport is where Sarif has golangci-lint write the SARIF report
+	sarifReport = "/tmp/golangci-lint.sarif"
+	// smokeTestBinary is where SmokeTest places the built binary, outside the source tree
+	smokeTestBinary = "/tmp/smoke-test"
+	// imageBinary is where Image places the built binary, both in the build container and the image
+	imageBinary = "/app"
+	// defaultLinterVersion mirrors the +default of the lint functions' version argument
+	defaultLinterVersion = "v2.4.0"
+)
+
+var (
+	// fuzzFuncPattern matches the name of a fuzz target
+	fuzzFuncPattern = regexp.MustCompile(`^Fuzz\w*$`)
+	// failingInputPattern captures the corpus entry go test writes a crashing fuzz input to
+	failingInputPattern = regexp.MustCompile(`Failing input written to (\S+)`)
+)
+
 // GolangCi module for Golang CI tasks
 type GolangCi struct {
+	// +private
+	CaCert *dagger.File
+	// +private
+	ContentCacheKey bool
 	// +private
 	GoVersion string
 	// +private
+	PackageMirror string
+	// +private
 	Source *dagger.Directory
 }
 
@@ -24,6 +61,18 @@ func New(
 	ctx context.Context,
 	// The source code directory
 	source *dagger.Directory,
+	// Key the module cache volume by the go.sum content hash. Identical dependency sets share a
+	// cache and distinct ones stay isolated, at the cost of more storage and no partial reuse when
+	// a single dependency changes. The build cache is always shared as Go keys it by content itself
+	// +optional
+	contentCacheKey bool,
+	// A custom CA certificate in PEM format to trust, e.g. for a TLS-inspecting proxy
+	// +optional
+	caCert *dagger.File,
+	// Base URL of a package mirror (e.g. https://mirror.example.com) to use instead of
+	// dl-cdn.alpinelinux.org and deb.debian.org. It must serve the /alpine and /debian paths
+	// +optional
+	packageMirror string,
 ) (*GolangCi, error) {
 	goVersion, err := goVersion(ctx, source)
 	if err != nil {
@@ -31,17 +80,34 @@ func New(
 	}
 
 	return &GolangCi{
-		GoVersion: goVersion,
-		Source:    source,
+		CaCert:          caCert,
+		ContentCacheKey: contentCacheKey,
+		GoVersion:       goVersion,
+		PackageMirror:   strings.TrimSuffix(packageMirror, "/"),
+		Source:          source,
 	}, nil
 }
 
 // base returns a Go container with the specified variant, dependencies installed, and source code
-func (m *GolangCi) base(variant string) *dagger.Container {
-	return dag.Container().
-		From("golang:"+m.GoVersion+"-"+variant).
+func (m *GolangCi) base(ctx context.Context, variant string) *dagger.Container {
+	ctr := dag.Container().
+		From(m.image(variant))
+
+	// Go reads the system trust store, so updating it covers go mod download and wget alike. The
+	// alpine image lacks update-ca-certificates, so the bundle is appended to directly there
+	if m.CaCert != nil {
+		ctr = ctr.
+			WithFile(caCertPath, m.CaCert).
+			WithExec([]string{"sh", "-c", trustCACommand(caCertPath, systemCABundle)})
+	}
+
+	if m.PackageMirror != "" {
+		ctr = ctr.WithExec([]string{"sh", "-c", mirrorCommand(variant, m.PackageMirror)})
+	}
+
+	return ctr.
 		WithWorkdir("/src").
-		WithMountedCache("/go/pkg/mod", dag.CacheVolume("go-mod-cache")).
+		WithMountedCache("/go/pkg/mod", dag.CacheVolume(m.modCacheName(ctx))).
 		WithMountedCache("/root/.cache/go-build", dag.CacheVolume("go-build-cache")).
 		WithFile("go.mod", m.Source.File("go.mod")).
 		WithFile("go.sum", m.Source.File("go.sum")).
@@ -49,14 +115,68 @@ func (m *GolangCi) base(variant string) *dagger.Container {
 		WithDirectory("/src", m.Source)
 }
 
+// trustCACommand returns the shell command adding the certificate to the system trust store,
+// appending it to the bundle directly on images without update-ca-certificates
+func trustCACommand(cert string, bundle string) string {
+	return "update-ca-certificates 2>/dev/null || cat " + cert + " >> " + bundle
+}
+
+// mirrorCommand returns the shell command pointing the variant's package manager at the mirror
+func mirrorCommand(variant, mirror string) string {
+	if variant == "alpine" {
+		return `sed -i -E "s#https?://dl-cdn.alpinelinux.org#` + mirror + `#g" /etc/apk/repositories`
+	}
+
+	return `sed -i -E "s#https?://deb.debian.org#` + mirror + `#g" /etc/apt/sources.list.d/debian.sources`
+}
+
+// modCacheName returns the module cache volume name, suffixed with the go.sum hash when content
+// cache keys are enabled
+func (m *GolangCi) modCacheName(ctx context.Context) string {
+	if !m.ContentCacheKey {
+		return "go-mod-cache"
+	}
+
+	digest, err := m.Source.File("go.sum").Digest(ctx, dagger.FileDigestOpts{ExcludeMetadata: true})
+	if err != nil {
+		return "go-mod-cache"
+	}
+
+	return "go-mod-cache-" + shortDigest(digest)
+}
+
+// shortDigest returns an abbreviated hex digest suitable for use in a cache volume name
+func shortDigest(digest string) string {
+	_, hex, ok := strings.Cut(digest, ":")
+	if !ok {
+		hex = digest
+	}
+
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+
+	return hex
+}
+
 // BaseAlpine returns the base alpine Go container with dependencies installed + source code
 func (m *GolangCi) BaseAlpine(ctx context.Context) *dagger.Container {
-	return m.base("alpine")
+	return m.base(ctx, "alpine")
 }
 
 // BaseDebian returns the base debian Go container with dependencies installed + source code
 func (m *GolangCi) BaseDebian(ctx context.Context) *dagger.Container {
-	return m.base("trixie")
+	return m.base(ctx, "trixie")
+}
+
+// WithOverlay merges a directory over the source, with overlay files taking precedence, e.g. to test
+// a patch without committing it. The Go version is still taken from the original go.mod
+func (m *GolangCi) WithOverlay(
+	// Files to overlay onto the source directory
+	overlay *dagger.Directory,
+) *GolangCi {
+	m.Source = m.Source.WithDirectory(".", overlay)
+	return m
 }
 
 // Lint runs golangci-lint on the source code
@@ -65,14 +185,71 @@ func (m *GolangCi) Lint(
 	// Go linter version
 	// +default="v2.4.0"
 	version string,
+	// Exit code when issues are found, 0 reports issues without failing
+	// +default=1
+	issuesExitCode int,
+) (string, error) {
+	return m.linter(ctx, version).
+		WithExec(lintArgs(issuesExitCode)).
+		Stdout(ctx)
+}
+
+// lintArgs returns the golangci-lint command exiting with the given code when issues are found
+func lintArgs(issuesExitCode int) []string {
+	return []string{"./bin/golangci-lint", "run", "--issues-exit-code=" + strconv.Itoa(issuesExitCode), "./..."}
+}
+
+// Sarif runs golangci-lint and returns the findings as a SARIF report for code scanning upload.
+// Lint findings do not cause an error, so the report is produced even when issues exist
+func (m *GolangCi) Sarif(
+	ctx context.Context,
+	// Go linter version
+	// +default="v2.4.0"
+	version string,
+) *dagger.File {
+	return m.linter(ctx, version).
+		WithExec(sarifArgs(sarifReport), dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+		File(sarifReport)
+}
+
+// sarifArgs returns the golangci-lint command writing a SARIF report to the given path
+func sarifArgs(report string) []string {
+	return []string{"./bin/golangci-lint", "run", "--output.sarif.path=" + report, "./..."}
+}
+
+// Staticcheck runs staticcheck on the source code, failing on any findings
+func (m *GolangCi) Staticcheck(
+	ctx context.Context,
+	// Staticcheck version
+	// +default="latest"
+	version string,
+	// Checks to enable, in staticcheck's -checks format (e.g. "all,-ST1000")
+	// +optional
+	checks string,
 ) (string, error) {
 	return m.BaseAlpine(ctx).
-		WithMountedCache("/root/.cache/golangci-lint", dag.CacheVolume("golangci-lint-cache")).
-		WithExec([]string{"sh", "-c", "wget -O- -nv https://raw.githubusercontent.com/golangci/golangci-lint/master/install.sh | sh -s " + version}).
-		WithExec([]string{"./bin/golangci-lint", "run", "./..."}).
+		WithExec([]string{"go", "install", "honnef.co/go/tools/cmd/staticcheck@" + version}).
+		WithExec(staticcheckArgs(checks)).
 		Stdout(ctx)
 }
 
+// staticcheckArgs returns the staticcheck command for the given checks
+func staticcheckArgs(checks string) []string {
+	args := []string{"staticcheck"}
+	if checks != "" {
+		args = append(args, "-checks", checks)
+	}
+
+	return append(args, "./...")
+}
+
+// linter returns the alpine container with the given golangci-lint version installed
+func (m *GolangCi) linter(ctx context.Context, version string) *dagger.Container {
+	return m.BaseAlpine(ctx).
+		WithMountedCache("/root/.cache/golangci-lint", dag.CacheVolume("golangci-lint-cache")).
+		WithExec([]string{"sh", "-c", "wget -O- -nv https://raw.githubusercontent.com/golangci/golangci-lint/master/install.sh | sh -s " + version})
+}
+
 // Build compiles the Go application
 func (m *GolangCi) Build(ctx context.Context) (string, error) {
 	return m.BaseAlpine(ctx).
@@ -80,11 +257,308 @@ func (m *GolangCi) Build(ctx context.Context) (string, error) {
 		Stdout(ctx)
 }
 
+// SumCheck verifies go.sum has a checksum for every module the packages and tests need and that the
+// downloaded modules match them, failing if go.mod or go.sum would have to change
+func (m *GolangCi) SumCheck(ctx context.Context) (string, error) {
+	// -mod=readonly makes go fail instead of adding missing go.sum entries, and go list loads every
+	// package so missing checksums for transitive imports are caught as well
+	ctr := m.BaseAlpine(ctx).
+		WithEnvVariable("GOFLAGS", "-mod=readonly").
+		WithExec(
+			[]string{"sh", "-c", "go mod download && go list -deps -test ./... > /dev/null && go mod verify"},
+			dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny},
+		)
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to check go.sum: %w", err)
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read go.sum check output: %w", err)
+	}
+
+	return sumCheckResult(out, exitCode)
+}
+
+// sumCheckResult returns the go.sum check output, failing with advice on fixing go.sum when the
+// check exited non-zero
+func sumCheckResult(out string, exitCode int) (string, error) {
+	if exitCode != 0 {
+		return out, fmt.Errorf("go.sum is incomplete or out of date, run go mod tidy and commit the result:\n%s", out)
+	}
+
+	return out, nil
+}
+
+// Image builds a main package as a static binary and returns a minimal container from the base image
+// with the binary as its entrypoint, ready to publish with the docker module
+func (m *GolangCi) Image(
+	ctx context.Context,
+	// Path to the main package to build
+	// +default="."
+	mainPath string,
+	// Image to copy the binary into, which must not need libc (e.g. scratch)
+	// +default="gcr.io/distroless/static"
+	base string,
+) *dagger.Container {
+	binary := m.BaseAlpine(ctx).
+		WithEnvVariable("CGO_ENABLED", "0").
+		WithExec(imageBuildArgs(mainPath, imageBinary)).
+		File(imageBinary)
+
+	// scratch can't be pulled, but an empty container is equivalent
+	ctr := dag.Container()
+	if base != "scratch" {
+		ctr = ctr.From(base)
+	}
+
+	return ctr.
+		WithFile(imageBinary, binary).
+		WithEntrypoint([]string{imageBinary})
+}
+
+// imageBuildArgs returns the command building the main package to output. With CGO disabled the
+// binary is statically linked, so it runs on images without libc
+func imageBuildArgs(mainPath string, output string) []string {
+	return []string{"go", "build", "-trimpath", "-o", output, mainPath}
+}
+
+// SmokeTest builds a main package and runs the binary with the given arguments, failing if it exits
+// with an error or its output doesn't contain the expected string
+func (m *GolangCi) SmokeTest(
+	ctx context.Context,
+	// Path to the main package to build
+	// +default="."
+	mainPath string,
+	// Arguments to run the binary with
+	// +optional
+	args []string,
+	// A string the combined stdout and stderr must contain
+	expectedOutput string,
+) (string, error) {
+	out, err := m.BaseAlpine(ctx).
+		WithExec([]string{"go", "build", "-o", smokeTestBinary, mainPath}).
+		WithExec(append([]string{smokeTestBinary}, args...)).
+		CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to build and run %s: %w", mainPath, err)
+	}
+
+	return smokeTestResult(out, mainPath, expectedOutput)
+}
+
+// smokeTestResult returns the binary's output, failing if it doesn't contain the expected string
+func smokeTestResult(out string, mainPath string, expectedOutput string) (string, error) {
+	if !strings.Contains(out, expectedOutput) {
+		return out, fmt.Errorf("output of %s does not contain %q", mainPath, expectedOutput)
+	}
+
+	return out, nil
+}
+
 // Test runs Go tests with coverage
-func (m *GolangCi) Test(ctx context.Context) (string, error) {
-	return m.BaseDebian(ctx).
-		WithExec([]string{"go", "test", "./..."}).
+func (m *GolangCi) Test(
+	ctx context.Context,
+	// Randomise the execution order of tests and benchmarks. The seed used is included in the output
+	// +optional
+	shuffle bool,
+	// Seed for the shuffled order, to reproduce a previous run. Implies shuffle
+	// +optional
+	shuffleSeed int,
+	// Run each test this many times, 1 bypasses cached test results
+	// +optional
+	count int,
+	// Clear the test result cache before running
+	// +optional
+	clearCache bool,
+	// Print every test's output. Otherwise a passing run returns a short summary, while a failing
+	// run always includes the full output
+	// +optional
+	verbose bool,
+) (string, error) {
+	// go test only prints the seed chosen by -shuffle=on for failing packages, so the seed is chosen
+	// here instead and reported for passing runs too
+	if shuffle && shuffleSeed == 0 {
+		shuffleSeed = rand.IntN(math.MaxInt32) + 1
+	}
+
+	ctr := m.BaseDebian(ctx)
+	if clearCache {
+		ctr = ctr.WithExec([]string{"go", "clean", "-testcache"})
+	}
+
+	ctr = ctr.WithExec(testArgs(shuffleSeed, count, verbose), dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run tests: %w", err)
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read test output: %w", err)
+	}
+
+	return testResult(out, exitCode, shuffleSeed, verbose)
+}
+
+// Fuzz runs a fuzz target for a bounded duration, failing with the failing input when a crasher is found.
+// The generated corpus is kept in the shared build cache, so later runs continue from it
+func (m *GolangCi) Fuzz(
+	ctx context.Context,
+	// Package containing the fuzz target
+	// +default="."
+	pkg string,
+	// Name of the fuzz target (e.g. FuzzParse)
+	fuzzFunc string,
+	// How long to fuzz for, as a duration (e.g. 30s) or a number of iterations (e.g. 1000x)
+	// +default="30s"
+	duration string,
+) (string, error) {
+	args, err := fuzzArgs(pkg, fuzzFunc, duration)
+	if err != nil {
+		return "", err
+	}
+
+	ctr := m.BaseDebian(ctx).
+		WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run fuzz test: %w", err)
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read fuzz test output: %w", err)
+	}
+
+	if exitCode == 0 {
+		return out, nil
+	}
+
+	// The failing input is written to the package's testdata/fuzz directory, so commit it there to
+	// keep it as a regression test
+	if matches := failingInputPattern.FindStringSubmatch(out); matches != nil {
+		entry := path.Join(pkg, matches[1])
+		if input, err := ctr.File(path.Join("/src", entry)).Contents(ctx); err == nil {
+			return "", fmt.Errorf("fuzz test %s failed with input %s:\n%s\n%s", fuzzFunc, entry, input, out)
+		}
+	}
+
+	return "", fmt.Errorf("fuzz test %s failed:\n%s", fuzzFunc, out)
+}
+
+// fuzzArgs returns the go test command fuzzing only the given target for the duration, skipping
+// the package's other tests
+func fuzzArgs(pkg string, fuzzFunc string, duration string) ([]string, error) {
+	if !fuzzFuncPattern.MatchString(fuzzFunc) {
+		return nil, fmt.Errorf("invalid fuzz target %q: must be a Go identifier starting with Fuzz", fuzzFunc)
+	}
+
+	if iterations, ok := strings.CutSuffix(duration, "x"); ok {
+		if n, err := strconv.Atoi(iterations); err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid fuzz duration %q: iteration count must be a positive integer", duration)
+		}
+	} else if d, err := time.ParseDuration(duration); err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid fuzz duration %q: must be a positive duration (e.g. 30s) or iteration count (e.g. 1000x)", duration)
+	}
+
+	return []string{"go", "test", "-run=^$", "-fuzz=^" + fuzzFunc + "$", "-fuzztime=" + duration, pkg}, nil
+}
+
+// TestJUnit runs Go tests and returns the results as a JUnit XML report, failing if any test fails
+func (m *GolangCi) TestJUnit(
+	ctx context.Context,
+	// go-junit-report version
+	// +default="latest"
+	version string,
+) (*dagger.File, error) {
+	ctr := m.BaseDebian(ctx).
+		WithExec([]string{"go", "install", "github.com/jstemmer/go-junit-report/v2@" + version}).
+		WithExec(
+			[]string{"go", "test", "-json", "./..."},
+			dagger.ContainerWithExecOpts{RedirectStdout: testJSONReport, Expect: dagger.ReturnTypeAny},
+		)
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run tests: %w", err)
+	}
+
+	report := ctr.
+		WithExec([]string{"go-junit-report", "-parser", "gojson", "-in", testJSONReport, "-out", junitReport}).
+		File(junitReport)
+
+	if exitCode != 0 {
+		events, _ := ctr.File(testJSONReport).Contents(ctx)
+		if failed := failedTests(events); len(failed) > 0 {
+			return nil, fmt.Errorf("tests failed: %s", strings.Join(failed, ", "))
+		}
+
+		stderr, _ := ctr.Stderr(ctx)
+		return nil, fmt.Errorf("tests failed with exit code %d: %s", exitCode, stderr)
+	}
+
+	return report, nil
+}
+
+// CoverageReport holds the results of a coverage run
+type CoverageReport struct {
+	// Total statement coverage percentage
+	Percentage float64
+	// The coverage profile, for upload to coverage tooling
+	Profile *dagger.File
+}
+
+// TestRaceCoverage runs Go tests with the race detector and atomic coverage in a single pass,
+// failing if a data race is detected or coverage is below the threshold
+func (m *GolangCi) TestRaceCoverage(
+	ctx context.Context,
+	// Minimum total coverage percentage required
+	// +default=0
+	threshold float64,
+	// Glob patterns of files to leave out of the coverage profile, matched against the file name
+	// or its full import path (e.g. "*_gen.go", "mock_*.go")
+	// +optional
+	excludePatterns []string,
+) (*CoverageReport, error) {
+	// The race detector requires cgo, which the debian image has a toolchain for
+	ctr := m.BaseDebian(ctx).
+		WithEnvVariable("CGO_ENABLED", "1").
+		WithExec([]string{"go", "test", "-race", "-covermode=atomic", "-coverprofile=" + coverProfile, "./..."})
+
+	if len(excludePatterns) > 0 {
+		profile, err := ctr.File(coverProfile).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("tests failed or a data race was detected: %w", err)
+		}
+
+		ctr = ctr.WithNewFile(coverProfile, filterProfile(profile, excludePatterns))
+	}
+
+	out, err := ctr.
+		WithExec([]string{"go", "tool", "cover", "-func=" + coverProfile}).
 		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tests failed or a data race was detected: %w", err)
+	}
+
+	percentage, err := parseCoverageTotal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	if percentage < threshold {
+		return nil, fmt.Errorf("coverage %.1f%% is below the threshold of %.1f%%", percentage, threshold)
+	}
+
+	return &CoverageReport{
+		Percentage: percentage,
+		Profile:    ctr.File(coverProfile),
+	}, nil
 }
 
 // All runs lint, build, and test in parallel
@@ -97,7 +571,7 @@ func (m *GolangCi) All(
 	g, ctx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		_, err := m.Lint(ctx, version)
+		_, err := m.Lint(ctx, version, 1)
 		return err
 	})
 
@@ -107,26 +581,211 @@ func (m *GolangCi) All(
 	})
 
 	g.Go(func() error {
-		_, err := m.Test(ctx)
+		_, err := m.Test(ctx, false, 0, 0, false, false)
 		return err
 	})
 
 	return g.Wait()
 }
 
+// ModuleInfo describes the configuration a module will run with
+type ModuleInfo struct {
+	// Name of the module
+	Module string
+	// Go version used by the base images
+	GoVersion string
+	// Default golangci-lint version
+	LinterVersion string
+	// Base image references
+	BaseImages []string
+}
+
+// Info returns the module name, tool versions and base images this instance will use
+func (m *GolangCi) Info(ctx context.Context) *ModuleInfo {
+	return &ModuleInfo{
+		Module:        "golang-ci",
+		GoVersion:     m.GoVersion,
+		LinterVersion: defaultLinterVersion,
+		BaseImages:    []string{m.image("alpine"), m.image("trixie")},
+	}
+}
+
+// image returns the Go image reference for a variant
+func (m *GolangCi) image(variant string) string {
+	return "golang:" + m.GoVersion + "-" + variant
+}
+
 // GolangVersion returns the Go version used in the module
 func (m *GolangCi) GolangVersion(ctx context.Context) string {
 	return m.GoVersion
 }
 
-// goVersion extracts the major.minor Go version from go.mod
-func goVersion(ctx context.Context, source *dagger.Directory) (string, error) {
+// GoVersionInfo holds the Go versions declared by go.mod
+type GoVersionInfo struct {
+	// Minimum Go version from the go directive (e.g. 1.22.0)
+	Go string
+	// Version from the toolchain directive (e.g. 1.22.3), empty when there is none
+	Toolchain string
+}
+
+// GoVersions returns the go and toolchain directive versions from go.mod, e.g. to choose the
+// versions to test against
+func (m *GolangCi) GoVersions(ctx context.Context) (*GoVersionInfo, error) {
+	f, err := parseGoMod(ctx, m.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Go == nil {
+		return nil, fmt.Errorf("go version not found in go.mod")
+	}
+
+	info := &GoVersionInfo{Go: f.Go.Version}
+	if f.Toolchain != nil {
+		info.Toolchain = strings.TrimPrefix(f.Toolchain.Name, "go")
+	}
+
+	return info, nil
+}
+
+// testArgs returns the go test command for the given options, shuffling with the seed unless it is 0
+func testArgs(shuffleSeed int, count int, verbose bool) []string {
+	args := []string{"go", "test"}
+
+	if verbose {
+		args = append(args, "-v")
+	}
+
+	if count > 0 {
+		args = append(args, "-count="+strconv.Itoa(count))
+	}
+
+	if shuffleSeed != 0 {
+		args = append(args, "-shuffle="+strconv.Itoa(shuffleSeed))
+	}
+
+	return append(args, "./...")
+}
+
+// testResult returns the go test output for the exit code, with passing runs summarised unless
+// verbose. The shuffle seed is appended so the test order can be reproduced
+func testResult(output string, exitCode int, shuffleSeed int, verbose bool) (string, error) {
+	if exitCode == 0 && !verbose {
+		output = summariseTests(output)
+	}
+
+	if shuffleSeed != 0 {
+		output = fmt.Sprintf("%s\nshuffle seed: %d", strings.TrimRight(output, "\n"), shuffleSeed)
+	}
+
+	if exitCode != 0 {
+		return "", fmt.Errorf("tests failed:\n%s", output)
+	}
+
+	return output, nil
+}
+
+// summariseTests condenses passing go test output into package counts
+func summariseTests(output string) string {
+	passed, untested := 0, 0
+
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.HasPrefix(line, "ok "):
+			passed++
+		case strings.HasPrefix(line, "? "):
+			untested++
+		}
+	}
+
+	return fmt.Sprintf("%d packages passed, %d without tests", passed, untested)
+}
+
+// failedTests returns the package qualified names of failed tests in `go test -json` output
+func failedTests(events string) []string {
+	var failed []string
+
+	for _, line := range strings.Split(events, "\n") {
+		var event struct {
+			Action  string
+			Package string
+			Test    string
+		}
+
+		if json.Unmarshal([]byte(line), &event) != nil || event.Action != "fail" || event.Test == "" {
+			continue
+		}
+
+		failed = append(failed, event.Package+"."+event.Test)
+	}
+
+	return failed
+}
+
+// filterProfile removes the blocks of files matching any of the patterns from a coverage profile
+func filterProfile(profile string, patterns []string) string {
+	var kept []string
+
+	for _, line := range strings.Split(profile, "\n") {
+		// Block lines have the form "path/to/file.go:1.2,3.4 1 0"
+		file, _, ok := strings.Cut(line, ":")
+		if ok && !strings.HasPrefix(line, "mode:") && matchesAny(file, patterns) {
+			continue
+		}
+
+		kept = append(kept, line)
+	}
+
+	return strings.Join(kept, "\n")
+}
+
+// matchesAny reports whether the file's name or full path matches any of the glob patterns
+func matchesAny(file string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, path.Base(file)); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, file); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCoverageTotal extracts the total coverage percentage from `go tool cover -func` output
+func parseCoverageTotal(output string) (float64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "total:" {
+			continue
+		}
+
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(fields[len(fields)-1], "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse coverage total %q: %w", line, err)
+		}
+
+		return percentage, nil
+	}
+
+	return 0, fmt.Errorf("coverage total not found in output")
+}
+
+// parseGoMod reads and parses go.mod from the source directory
+func parseGoMod(ctx context.Context, source *dagger.Directory) (*modfile.File, error) {
 	goMod, err := source.File("go.mod").Contents(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	f, err := modfile.Parse("go.mod", []byte(goMod), nil)
+	return modfile.Parse("go.mod", []byte(goMod), nil)
+}
+
+// goVersion extracts the major.minor Go version from go.mod
+func goVersion(ctx context.Context, source *dagger.Directory) (string, error) {
+	f, err := parseGoMod(ctx, source)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTestArgsShuffle(t *testing.T) {
+	tests := []struct {
+		name        string
+		shuffleSeed int
+		want        []string
+	}{
+		{"in order", 0, []string{"go", "test", "./..."}},
+		{"seed", 42, []string{"go", "test", "-shuffle=42", "./..."}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testArgs(tt.shuffleSeed, 0, false); !slices.Equal(got, tt.want) {
+				t.Errorf("testArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTestResultShuffleSeed(t *testing.T) {
+	output := "ok  \texample.com/app\t0.012s\n"
+
+	got, err := testResult(output, 0, 42, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "1 packages passed, 0 without tests\nshuffle seed: 42"; got != want {
+		t.Errorf("testResult() = %q, want %q", got, want)
+	}
+
+	if _, err := testResult(output, 1, 42, false); err == nil || !strings.Contains(err.Error(), "shuffle seed: 42") {
+		t.Errorf("testResult() error = %v, want one including the shuffle seed", err)
+	}
+}
+
+func TestShortDigest(t *testing.T) {
+	tests := []struct {
+		digest string
+		want   string
+	}{
+		{"sha256:0123456789abcdef0123456789abcdef", "0123456789ab"},
+		{"0123456789abcdef", "0123456789ab"},
+		{"sha256:abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.digest, func(t *testing.T) {
+			if got := shortDigest(tt.digest); got != tt.want {
+				t.Errorf("shortDigest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCoverageTotal(t *testing.T) {
+	output := `example.com/app/main.go:10:	main		0.0%
+example.com/app/calc.go:5:	Add		100.0%
+total:					(statements)	83.3%
+`
+
+	got, err := parseCoverageTotal(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 83.3 {
+		t.Errorf("parseCoverageTotal() = %v, want 83.3", got)
+	}
+
+	if _, err := parseCoverageTotal("example.com/app/main.go:10:	main	0.0%"); err == nil {
+		t.Error("parseCoverageTotal() without a total succeeded, want an error")
+	}
+}
+
+func TestLintArgs(t *testing.T) {
+	tests := []struct {
+		issuesExitCode int
+		want           []string
+	}{
+		{1, []string{"./bin/golangci-lint", "run", "--issues-exit-code=1", "./..."}},
+		{0, []string{"./bin/golangci-lint", "run", "--issues-exit-code=0", "./..."}},
+		{3, []string{"./bin/golangci-lint", "run", "--issues-exit-code=3", "./..."}},
+	}
+
+	for _, tt := range tests {
+		if got := lintArgs(tt.issuesExitCode); !slices.Equal(got, tt.want) {
+			t.Errorf("lintArgs(%d) = %q, want %q", tt.issuesExitCode, got, tt.want)
+		}
+	}
+}
+
+func TestSarifArgs(t *testing.T) {
+	want := []string{"./bin/golangci-lint", "run", "--output.sarif.path=/tmp/golangci-lint.sarif", "./..."}
+	if got := sarifArgs(sarifReport); !slices.Equal(got, want) {
+		t.Errorf("sarifArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestSumCheckResult(t *testing.T) {
+	if got, err := sumCheckResult("all modules verified\n", 0); err != nil || got != "all modules verified\n" {
+		t.Errorf("sumCheckResult() = %q, %v, want the output and no error", got, err)
+	}
+
+	missing := "main.go:5:2: missing go.sum entry for module providing package golang.org/x/mod/modfile\n"
+
+	got, err := sumCheckResult(missing, 1)
+	if err == nil {
+		t.Fatal("sumCheckResult() with a failed check succeeded, want an error")
+	}
+
+	if got != missing || !strings.Contains(err.Error(), "go mod tidy") || !strings.Contains(err.Error(), missing) {
+		t.Errorf("sumCheckResult() = %q, %v, want the output and advice to run go mod tidy", got, err)
+	}
+}
+
+func TestSmokeTestResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		expected string
+		wantErr  bool
+	}{
+		{"contains the output", "server v1.2.3\nlistening on :8080\n", "v1.2.3", false},
+		{"matches across lines", "usage: server\n  -port int\n", "usage: server\n  -port", false},
+		{"missing output", "panic: runtime error\n", "v1.2.3", true},
+		{"empty output", "", "v1.2.3", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := smokeTestResult(tt.out, "./cmd/server", tt.expected)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("smokeTestResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.out {
+				t.Errorf("smokeTestResult() = %q, want the binary output %q", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestImageBuildArgs(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not available")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":             "module example.com/server\n\ngo 1.22\n",
+		"cmd/server/main.go": "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"ok\") }\n",
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	binary := filepath.Join(dir, "app")
+	args := imageBuildArgs("./cmd/server", binary)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOWORK=off", "GOFLAGS=")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build error = %v\n%s", err, out)
+	}
+
+	f, err := elf.Open(binary)
+	if err != nil {
+		t.Skipf("binary isn't ELF on this platform: %v", err)
+	}
+	defer f.Close()
+
+	// A dynamically linked binary names the loader it needs, which images like scratch don't have
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			t.Error("image binary is dynamically linked, want a static binary")
+		}
+	}
+
+	if out, err := exec.Command(binary).Output(); err != nil || string(out) != "ok\n" {
+		t.Errorf("image binary output = %q, %v, want %q", out, err, "ok\n")
+	}
+}
+
+func TestStaticcheckArgs(t *testing.T) {
+	if got, want := staticcheckArgs(""), []string{"staticcheck", "./..."}; !slices.Equal(got, want) {
+		t.Errorf("staticcheckArgs() = %q, want %q", got, want)
+	}
+
+	if got, want := staticcheckArgs("all,-ST1000"), []string{"staticcheck", "-checks", "all,-ST1000", "./..."}; !slices.Equal(got, want) {
+		t.Errorf("staticcheckArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestMirrorCommand(t *testing.T) {
+	tests := []struct {
+		variant string
+		want    string
+	}{
+		{"alpine", `sed -i -E "s#https?://dl-cdn.alpinelinux.org#https://mirror.example.com#g" /etc/apk/repositories`},
+		{"debian", `sed -i -E "s#https?://deb.debian.org#https://mirror.example.com#g" /etc/apt/sources.list.d/debian.sources`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.variant, func(t *testing.T) {
+			if got := mirrorCommand(tt.variant, "https://mirror.example.com"); got != tt.want {
+				t.Errorf("mirrorCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailedTests(t *testing.T) {
+	events := `{"Action":"run","Package":"example.com/app","Test":"TestAdd"}
+{"Action":"pass","Package":"example.com/app","Test":"TestAdd"}
+{"Action":"fail","Package":"example.com/app","Test":"TestSub"}
+{"Action":"fail","Package":"example.com/app/calc","Test":"TestDiv/by_zero"}
+{"Action":"fail","Package":"example.com/app"}
+not json
+`
+
+	got := failedTests(events)
+	want := []string{"example.com/app.TestSub", "example.com/app/calc.TestDiv/by_zero"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("failedTests() = %q, want %q", got, want)
+	}
+}
+
+func TestFilterProfile(t *testing.T) {
+	profile := `mode: atomic
+example.com/app/calc.go:3.20,5.2 1 1
+example.com/app/calc_mock.go:3.20,5.2 1 0
+example.com/app/gen/api.pb.go:3.20,5.2 1 0
+example.com/app/main.go:3.13,5.2 1 1`
+
+	want := `mode: atomic
+example.com/app/calc.go:3.20,5.2 1 1
+example.com/app/main.go:3.13,5.2 1 1`
+
+	if got := filterProfile(profile, []string{"*_mock.go", "example.com/app/gen/*"}); got != want {
+		t.Errorf("filterProfile() =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := filterProfile(profile, nil); got != profile {
+		t.Errorf("filterProfile() without patterns =\n%s\nwant the profile unchanged", got)
+	}
+}
+
+func TestTestArgsCount(t *testing.T) {
+	if got, want := testArgs(0, 1, false), []string{"go", "test", "-count=1", "./..."}; !slices.Equal(got, want) {
+		t.Errorf("testArgs() = %q, want %q", got, want)
+	}
+
+	if got, want := testArgs(0, 0, false), []string{"go", "test", "./..."}; !slices.Equal(got, want) {
+		t.Errorf("testArgs() without a count = %q, want %q", got, want)
+	}
+}
+
+func TestTestArgsVerbose(t *testing.T) {
+	if got, want := testArgs(42, 1, true), []string{"go", "test", "-v", "-count=1", "-shuffle=42", "./..."}; !slices.Equal(got, want) {
+		t.Errorf("testArgs() = %q, want %q", got, want)
+	}
+
+	if got := testArgs(42, 1, false); slices.Contains(got, "-v") {
+		t.Errorf("testArgs() = %q, want no -v unless verbose", got)
+	}
+}
+
+func TestTestResult(t *testing.T) {
+	// Output of go test ./... without -v, which only prints test output for failing packages
+	passing := `ok  	example.com/app	0.012s
+ok  	example.com/app/calc	(cached)
+?   	example.com/app/cmd	[no test files]
+`
+
+	failing := `ok  	example.com/app	0.001s
+--- FAIL: TestDiv (0.00s)
+    calc_test.go:12: division by zero
+FAIL
+FAIL	example.com/app/calc	0.001s
+?   	example.com/app/cmd	[no test files]
+FAIL
+`
+
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+		verbose  bool
+		want     string
+		wantErr  string
+	}{
+		{"passing run is summarised", passing, 0, false, "2 packages passed, 1 without tests", ""},
+		{"verbose passing run keeps the output", passing, 0, true, passing, ""},
+		{"failing run keeps the output", failing, 1, false, "", "--- FAIL: TestDiv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testResult(tt.output, tt.exitCode, 0, tt.verbose)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("testResult() error = %v, want one containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("testResult() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFuzzArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		fuzzFunc string
+		duration string
+		want     []string
+	}{
+		{"duration", "FuzzParse", "30s", []string{"go", "test", "-run=^$", "-fuzz=^FuzzParse$", "-fuzztime=30s", "./parser"}},
+		{"iterations", "FuzzParse", "1000x", []string{"go", "test", "-run=^$", "-fuzz=^FuzzParse$", "-fuzztime=1000x", "./parser"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fuzzArgs("./parser", tt.fuzzFunc, tt.duration)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("fuzzArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFuzzArgsInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		fuzzFunc string
+		duration string
+	}{
+		{"not a fuzz target", "TestParse", "30s"},
+		{"regexp target", "Fuzz.*", "30s"},
+		{"zero duration", "FuzzParse", "0s"},
+		{"bad duration", "FuzzParse", "soon"},
+		{"zero iterations", "FuzzParse", "0x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := fuzzArgs("./parser", tt.fuzzFunc, tt.duration); err == nil {
+				t.Error("fuzzArgs() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestTrustCACommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	tests := []struct {
+		name       string
+		updateExit int
+		wantBundle string
+	}{
+		{"updates the trust store", 0, "system\n"},
+		{"appends without update-ca-certificates", 127, "system\ncustom\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cert := filepath.Join(dir, "custom-ca.crt")
+			bundle := filepath.Join(dir, "ca-certificates.crt")
+
+			if err := os.WriteFile(cert, []byte("custom\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(bundle, []byte("system\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// The stub stands in for update-ca-certificates, exiting 127 as if it weren't installed
+			stub := fmt.Sprintf("exit %d\n", tt.updateExit)
+			if err := os.WriteFile(filepath.Join(dir, "update-ca-certificates"), []byte(stub), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("sh", "-c", trustCACommand(cert, bundle))
+			cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("trust CA command error = %v\n%s", err, out)
+			}
+
+			got, err := os.ReadFile(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.wantBundle {
+				t.Errorf("CA bundle = %q, want %q", got, tt.wantBundle)
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	got := (&GolangCi{GoVersion: "1.25.1"}).Info(context.Background())
+
+	if got.Module != "golang-ci" || got.GoVersion != "1.25.1" || got.LinterVersion != defaultLinterVersion {
+		t.Errorf("Info() = %+v, want golang-ci with Go 1.25.1 and the default linter", got)
+	}
+
+	// The images must be the ones BaseAlpine and BaseDebian build from
+	want := []string{"golang:1.25.1-alpine", "golang:1.25.1-trixie"}
+	if !slices.Equal(got.BaseImages, want) {
+		t.Errorf("Info() base images = %q, want %q", got.BaseImages, want)
+	}
+}
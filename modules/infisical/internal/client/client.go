@@ -2,15 +2,18 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 
 	infisical "github.com/infisical/go-sdk"
 )
 
 var (
-	clientInstance infisical.InfisicalClientInterface
-	clientMutex    sync.RWMutex
+	clients     = make(map[clientKey]infisical.InfisicalClientInterface)
+	clientMutex sync.RWMutex
 )
 
 // Config holds the configuration for creating an Infisical client
@@ -22,12 +25,22 @@ type Config struct {
 	Environment  string
 }
 
-// GetClient returns a cached client or creates a new one if needed
+// clientKey identifies an authenticated client. Project and environment are per request, so
+// clients are shared across them
+type clientKey struct {
+	siteURL      string
+	clientID     string
+	clientSecret string
+}
+
+// GetClient returns a cached client for the config's credentials or creates a new one if needed
 func GetClient(ctx context.Context, cfg Config) (infisical.InfisicalClientInterface, error) {
+	key := clientKey{siteURL: cfg.SiteURL, clientID: cfg.ClientID, clientSecret: cfg.ClientSecret}
+
 	clientMutex.RLock()
-	if clientInstance != nil {
+	if client, ok := clients[key]; ok {
 		clientMutex.RUnlock()
-		return clientInstance, nil
+		return client, nil
 	}
 	clientMutex.RUnlock()
 
@@ -35,8 +48,8 @@ func GetClient(ctx context.Context, cfg Config) (infisical.InfisicalClientInterf
 	defer clientMutex.Unlock()
 
 	// Double-check after acquiring write lock
-	if clientInstance != nil {
-		return clientInstance, nil
+	if client, ok := clients[key]; ok {
+		return client, nil
 	}
 
 	client := infisical.NewInfisicalClient(ctx, infisical.Config{
@@ -48,8 +61,8 @@ func GetClient(ctx context.Context, cfg Config) (infisical.InfisicalClientInterf
 		return nil, fmt.Errorf("failed to authenticate with infisical: %w", err)
 	}
 
-	clientInstance = client
-	return clientInstance, nil
+	clients[key] = client
+	return client, nil
 }
 
 // RetrieveSecret retrieves a secret from Infisical
@@ -71,3 +84,40 @@ func RetrieveSecret(ctx context.Context, cfg Config, key string) (string, error)
 
 	return secret.SecretValue, nil
 }
+
+// unavailableMarkers are error message fragments indicating Infisical couldn't be reached, as the
+// SDK doesn't always wrap the underlying network error
+var unavailableMarkers = []string{
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"network is unreachable",
+	"i/o timeout",
+	"tls handshake timeout",
+	"context deadline exceeded",
+	"status-code=502",
+	"status-code=503",
+	"status-code=504",
+}
+
+// IsUnavailable reports whether an error was caused by Infisical being unreachable, as opposed to
+// an authentication or missing secret error
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, marker := range unavailableMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+
+	return false
+}
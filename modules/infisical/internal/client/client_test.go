@@ -0,0 +1,38 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"net error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("refused")}, true},
+		{"wrapped net error", fmt.Errorf("failed to get secret KEY: %w", &net.DNSError{Err: "server misbehaving", Name: "infisical.example.com"}), true},
+		{"authentication error", errors.New("failed to authenticate with infisical: [status-code=401] invalid credentials"), false},
+		{"missing secret", errors.New("failed to get secret KEY: [status-code=404] Secret not found"), false},
+	}
+
+	for _, marker := range unavailableMarkers {
+		tests = append(tests, struct {
+			name string
+			err  error
+			want bool
+		}{marker, fmt.Errorf("failed to get secret KEY: Get \"https://infisical.example.com\": %s", marker), true})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsUnavailable(tt.err); got != tt.want {
+				t.Errorf("IsUnavailable(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,10 +3,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
 
 	"dagger/infisical/internal/client"
 	"dagger/infisical/internal/dagger"
+
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -77,20 +84,262 @@ func (m *Infisical) WithEnvironment(environment string) *Infisical {
 	return m
 }
 
-// GetSecret retrieves a single secret from Infisical
-func (m *Infisical) GetSecret(ctx context.Context, key string) (*dagger.Secret, error) {
-	cfg := client.Config{
-		SiteURL:      infisicalSite,
-		ClientID:     m.ClientID,
-		ClientSecret: m.ClientSecret,
-		ProjectID:    m.ProjectId,
-		Environment:  m.Environment,
+// secretFetcher retrieves a secret value from Infisical, which is client.RetrieveSecret outside tests
+type secretFetcher func(ctx context.Context, cfg client.Config, key string) (string, error)
+
+// GetSecret retrieves a single secret from Infisical. Falling back to environment variables isn't
+// supported, as module functions can't read the caller's environment; use fallbackFile instead
+func (m *Infisical) GetSecret(
+	ctx context.Context,
+	// The secret key
+	key string,
+	// A dotenv file of KEY=VALUE pairs to read the secret from when Infisical is unreachable.
+	// Authentication and missing secret errors still fail
+	// +optional
+	fallbackFile *dagger.File,
+) (*dagger.Secret, error) {
+	var fallback func() (string, error)
+	if fallbackFile != nil {
+		fallback = func() (string, error) { return fallbackFile.Contents(ctx) }
 	}
 
-	secretValue, err := client.RetrieveSecret(ctx, cfg, key)
+	secretValue, err := retrieveWithFallback(ctx, m.config(), key, fallback, client.RetrieveSecret)
 	if err != nil {
 		return nil, err
 	}
 
 	return dag.SetSecret(key, secretValue), nil
 }
+
+// retrieveWithFallback fetches a secret, reading it from the dotenv contents returned by fallback
+// instead when Infisical is unreachable. A nil fallback returns the Infisical error as-is
+func retrieveWithFallback(ctx context.Context, cfg client.Config, key string, fallback func() (string, error), fetch secretFetcher) (string, error) {
+	value, err := fetch(ctx, cfg, key)
+	if err == nil || fallback == nil || !client.IsUnavailable(err) {
+		return value, err
+	}
+
+	contents, readErr := fallback()
+	if readErr != nil {
+		return "", fmt.Errorf("infisical is unavailable (%w) and the fallback file can't be read: %v", err, readErr)
+	}
+
+	value, ok := parseDotenv(contents)[key]
+	if !ok {
+		return "", fmt.Errorf("infisical is unavailable (%w) and %s is not in the fallback file", err, key)
+	}
+
+	fmt.Fprintf(os.Stderr, "infisical is unavailable, using fallback value for %s: %v\n", key, err)
+	return value, nil
+}
+
+// parseDotenv parses KEY=VALUE lines, ignoring blank lines and comments and stripping an optional
+// export prefix and surrounding quotes
+func parseDotenv(contents string) map[string]string {
+	values := make(map[string]string)
+
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		values[strings.TrimSpace(key)] = value
+	}
+
+	return values
+}
+
+// SecretResult is a secret retrieved by GetSecrets
+type SecretResult struct {
+	// The secret key
+	Key string
+	// The secret value
+	Secret *dagger.Secret
+}
+
+// GetSecrets retrieves several secrets in parallel, at most maxConcurrency at a time. Secrets that
+// were retrieved are returned alongside an error listing every key that failed
+func (m *Infisical) GetSecrets(
+	ctx context.Context,
+	// The secret keys
+	keys []string,
+	// Maximum number of secrets to request from Infisical at once
+	// +default=4
+	maxConcurrency int,
+) ([]*SecretResult, error) {
+	if maxConcurrency < 1 {
+		return nil, fmt.Errorf("max concurrency must be at least 1")
+	}
+
+	values, err := retrieveSecrets(ctx, m.config(), keys, maxConcurrency, client.RetrieveSecret)
+
+	results := make([]*SecretResult, 0, len(values))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			results = append(results, &SecretResult{Key: key, Secret: dag.SetSecret(key, value)})
+		}
+	}
+
+	return results, err
+}
+
+// retrieveSecrets fetches the keys with at most maxConcurrency requests in flight. The values that
+// were retrieved are returned by key alongside an error joining every failure
+func retrieveSecrets(ctx context.Context, cfg client.Config, keys []string, maxConcurrency int, fetch secretFetcher) (map[string]string, error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	// Failures are collected per key rather than returned, so one missing secret doesn't cancel the rest
+	var g errgroup.Group
+	g.SetLimit(maxConcurrency)
+
+	for i, key := range keys {
+		g.Go(func() error {
+			values[i], errs[i] = fetch(ctx, cfg, key)
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+
+	retrieved := make(map[string]string, len(keys))
+	for i, key := range keys {
+		if errs[i] == nil {
+			retrieved[key] = values[i]
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return retrieved, fmt.Errorf("failed to retrieve %d of %d secrets: %w", len(keys)-len(retrieved), len(keys), err)
+	}
+
+	return retrieved, nil
+}
+
+// GetSecretFrom retrieves a single secret from the given project and environment, without
+// changing the instance's defaults
+func (m *Infisical) GetSecretFrom(
+	ctx context.Context,
+	// The Infisical Project ID to read from
+	projectId string,
+	// The environment to read from
+	environment string,
+	// The secret key
+	key string,
+) (*dagger.Secret, error) {
+	secretValue, err := client.RetrieveSecret(ctx, m.configFor(projectId, environment), key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scope the secret name so the same key read from different projects doesn't collide
+	return dag.SetSecret(scopedSecretName(projectId, environment, key), secretValue), nil
+}
+
+// scopedSecretName returns a secret name unique to the project and environment it was read from
+func scopedSecretName(projectId string, environment string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", projectId, environment, name)
+}
+
+// RenderTemplate replaces secret placeholders such as {{ SECRET_NAME }} in a template with their values
+// from Infisical, failing if any referenced secret can't be retrieved. The rendered template is
+// returned as a secret so it is never stored as plaintext; mount it with WithMountedSecret
+func (m *Infisical) RenderTemplate(
+	ctx context.Context,
+	// The template file containing secret placeholders
+	template *dagger.File,
+	// The delimiter opening a placeholder
+	// +default="{{"
+	openDelimiter string,
+	// The delimiter closing a placeholder
+	// +default="}}"
+	closeDelimiter string,
+) (*dagger.Secret, error) {
+	if openDelimiter == "" || closeDelimiter == "" {
+		return nil, fmt.Errorf("placeholder delimiters must not be empty")
+	}
+
+	name, err := template.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get template name: %w", err)
+	}
+
+	contents, err := template.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+
+	cfg := m.config()
+	rendered, err := render(contents, placeholderPattern(openDelimiter, closeDelimiter), func(key string) (string, error) {
+		return client.RetrieveSecret(ctx, cfg, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Scope the secret name like GetSecretFrom so templates of the same name don't collide
+	return dag.SetSecret(scopedSecretName(m.ProjectId, m.Environment, name), rendered), nil
+}
+
+// placeholderPattern matches a secret placeholder between the delimiters, capturing the secret key
+func placeholderPattern(openDelimiter string, closeDelimiter string) *regexp.Regexp {
+	return regexp.MustCompile(regexp.QuoteMeta(openDelimiter) + `\s*([A-Za-z_][A-Za-z0-9_]*)\s*` + regexp.QuoteMeta(closeDelimiter))
+}
+
+// render replaces every placeholder in the contents with the value lookup returns for its key,
+// looking each key up once and failing with every key that couldn't be retrieved
+func render(contents string, placeholder *regexp.Regexp, lookup func(key string) (string, error)) (string, error) {
+	values := make(map[string]string)
+	var missing []string
+
+	for _, match := range placeholder.FindAllStringSubmatch(contents, -1) {
+		key := match[1]
+		if _, ok := values[key]; ok || slices.Contains(missing, key) {
+			continue
+		}
+
+		value, err := lookup(key)
+		if err != nil {
+			missing = append(missing, key)
+			continue
+		}
+
+		values[key] = value
+	}
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("failed to retrieve secrets referenced by template: %s", strings.Join(missing, ", "))
+	}
+
+	return placeholder.ReplaceAllStringFunc(contents, func(match string) string {
+		return values[placeholder.FindStringSubmatch(match)[1]]
+	}), nil
+}
+
+// config returns the client configuration for the current project and environment
+func (m *Infisical) config() client.Config {
+	return m.configFor(m.ProjectId, m.Environment)
+}
+
+// configFor returns the client configuration for a project and environment, sharing the instance's
+// credentials
+func (m *Infisical) configFor(projectId string, environment string) client.Config {
+	return client.Config{
+		SiteURL:      infisicalSite,
+		ClientID:     m.ClientID,
+		ClientSecret: m.ClientSecret,
+		ProjectID:    projectId,
+		Environment:  environment,
+	}
+}
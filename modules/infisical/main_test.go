@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dagger/infisical/internal/client"
+)
+
+func TestParseDotenv(t *testing.T) {
+	contents := `# fallback values
+DB_HOST=localhost
+export DB_USER = admin
+DB_PASSWORD="p@ss=word"
+API_KEY='abc123'
+EMPTY=
+not a pair
+`
+
+	want := map[string]string{
+		"DB_HOST":     "localhost",
+		"DB_USER":     "admin",
+		"DB_PASSWORD": "p@ss=word",
+		"API_KEY":     "abc123",
+		"EMPTY":       "",
+	}
+
+	if got := parseDotenv(contents); !maps.Equal(got, want) {
+		t.Errorf("parseDotenv() = %v, want %v", got, want)
+	}
+}
+
+func TestRetrieveWithFallback(t *testing.T) {
+	unreachable := fmt.Errorf("failed to get secret DB_PASSWORD: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	forbidden := errors.New("failed to get secret DB_PASSWORD: CallRetrieveSecretV3: Unsuccessful response [GET ...] [status-code=403]")
+	fallbackFile := func() (string, error) { return "DB_PASSWORD=from-fallback\n", nil }
+
+	tests := []struct {
+		name     string
+		fetchErr error
+		fallback func() (string, error)
+		key      string
+		want     string
+		wantErr  string
+	}{
+		{"infisical available", nil, fallbackFile, "DB_PASSWORD", "from-infisical", ""},
+		{"unreachable uses the fallback", unreachable, fallbackFile, "DB_PASSWORD", "from-fallback", ""},
+		{"unreachable without a fallback", unreachable, nil, "DB_PASSWORD", "", "connection refused"},
+		{"key missing from the fallback", unreachable, fallbackFile, "API_KEY", "", "API_KEY is not in the fallback file"},
+		{"unreadable fallback", unreachable, func() (string, error) { return "", errors.New("no such file") }, "DB_PASSWORD", "", "fallback file can't be read"},
+		{"auth errors don't fall back", forbidden, fallbackFile, "DB_PASSWORD", "", "status-code=403"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetch := func(ctx context.Context, cfg client.Config, key string) (string, error) {
+				if tt.fetchErr != nil {
+					return "", tt.fetchErr
+				}
+
+				return "from-infisical", nil
+			}
+
+			got, err := retrieveWithFallback(context.Background(), client.Config{}, tt.key, tt.fallback, fetch)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("retrieveWithFallback() error = %v, want one containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("retrieveWithFallback() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	secrets := map[string]string{"DB_HOST": "db.internal", "DB_PASSWORD": "s3cr${et}"}
+	calls := make(map[string]int)
+
+	lookup := func(key string) (string, error) {
+		calls[key]++
+
+		value, ok := secrets[key]
+		if !ok {
+			return "", fmt.Errorf("secret %s not found", key)
+		}
+
+		return value, nil
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		open     string
+		close    string
+		want     string
+		wantErr  string
+	}{
+		{"placeholders", "host={{ DB_HOST }}\npassword={{DB_PASSWORD}}\n", "{{", "}}", "host=db.internal\npassword=s3cr${et}\n", ""},
+		{"repeated placeholder", "{{ DB_HOST }}:{{ DB_HOST }}", "{{", "}}", "db.internal:db.internal", ""},
+		{"literal text", "{{ not a key }} {{ 1ST }} {DB_HOST} $DB_HOST", "{{", "}}", "{{ not a key }} {{ 1ST }} {DB_HOST} $DB_HOST", ""},
+		{"custom delimiters", "url=<% DB_HOST %> keep={{ DB_HOST }}", "<%", "%>", "url=db.internal keep={{ DB_HOST }}", ""},
+		{"unknown keys", "{{ DB_HOST }} {{ API_KEY }} {{ TOKEN }} {{ API_KEY }}", "{{", "}}", "", "API_KEY, TOKEN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(calls)
+
+			got, err := render(tt.template, placeholderPattern(tt.open, tt.close), lookup)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("render() error = %v, want one containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("render() = %q, %v, want %q", got, err, tt.want)
+			}
+
+			for key, n := range calls {
+				if n > 1 {
+					t.Errorf("render() looked up %s %d times, want once", key, n)
+				}
+			}
+		})
+	}
+}
+
+func TestRetrieveSecretsBoundsConcurrency(t *testing.T) {
+	keys := []string{"A", "B", "C", "D", "E", "F", "G", "H", "MISSING", "J"}
+	const maxConcurrency = 3
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	fetched := make(map[string]bool)
+
+	// The counting stub holds each call open briefly so concurrent calls overlap
+	fetch := func(ctx context.Context, cfg client.Config, key string) (string, error) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		fetched[key] = true
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		if key == "MISSING" {
+			return "", fmt.Errorf("failed to get secret %s: not found", key)
+		}
+
+		return strings.ToLower(key), nil
+	}
+
+	got, err := retrieveSecrets(context.Background(), client.Config{}, keys, maxConcurrency, fetch)
+
+	if peak > maxConcurrency {
+		t.Errorf("retrieveSecrets() ran %d fetches at once, want at most %d", peak, maxConcurrency)
+	}
+
+	if peak < 2 {
+		t.Errorf("retrieveSecrets() ran at most %d fetch at once, want fetches in parallel", peak)
+	}
+
+	if len(fetched) != len(keys) {
+		t.Errorf("retrieveSecrets() fetched %d keys, want all %d", len(fetched), len(keys))
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "failed to retrieve 1 of 10 secrets") || !strings.Contains(err.Error(), "MISSING") {
+		t.Errorf("retrieveSecrets() error = %v, want the failed key joined", err)
+	}
+
+	if len(got) != len(keys)-1 || got["A"] != "a" || got["J"] != "j" {
+		t.Errorf("retrieveSecrets() = %v, want the partial results", got)
+	}
+
+	if _, ok := got["MISSING"]; ok {
+		t.Error("retrieveSecrets() returned a value for the failed key")
+	}
+}
+
+func TestConfigForProjects(t *testing.T) {
+	m := &Infisical{ClientID: "client", ClientSecret: "secret", ProjectId: "infrastructure", Environment: "prod"}
+
+	// The stub stores the same key in both projects with different values
+	secrets := map[string]string{
+		"infrastructure/prod/DB_PASSWORD": "infra-password",
+		"apps/staging/DB_PASSWORD":        "apps-password",
+	}
+
+	fetch := func(ctx context.Context, cfg client.Config, key string) (string, error) {
+		if cfg.ClientID != m.ClientID || cfg.ClientSecret != m.ClientSecret {
+			return "", errors.New("credentials not shared")
+		}
+
+		value, ok := secrets[scopedSecretName(cfg.ProjectID, cfg.Environment, key)]
+		if !ok {
+			return "", fmt.Errorf("secret %s not found", key)
+		}
+
+		return value, nil
+	}
+
+	reads := []struct {
+		projectId, environment, want string
+	}{
+		{"apps", "staging", "apps-password"},
+		{"infrastructure", "prod", "infra-password"},
+		{"apps", "staging", "apps-password"},
+	}
+
+	for _, read := range reads {
+		got, err := fetch(context.Background(), m.configFor(read.projectId, read.environment), "DB_PASSWORD")
+		if err != nil || got != read.want {
+			t.Errorf("DB_PASSWORD from %s/%s = %q, %v, want %q", read.projectId, read.environment, got, err, read.want)
+		}
+	}
+
+	if m.ProjectId != "infrastructure" || m.Environment != "prod" || m.config() != m.configFor("infrastructure", "prod") {
+		t.Errorf("instance defaults changed to %s/%s", m.ProjectId, m.Environment)
+	}
+
+	if a, b := scopedSecretName("apps", "staging", "DB_PASSWORD"), scopedSecretName("infrastructure", "prod", "DB_PASSWORD"); a == b {
+		t.Errorf("scopedSecretName() = %q for both projects, want distinct names", a)
+	}
+}
@@ -4,10 +4,17 @@ package main
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"dagger/mysql/internal/dagger"
 )
 
+// imageVersionPattern matches the major and optional minor version at the start of a MySQL image tag
+var imageVersionPattern = regexp.MustCompile(`^(\d+)(?:\.(\d+))?`)
+
 type Mysql struct {
 	// +private
 	Version string
@@ -16,6 +23,14 @@ type Mysql struct {
 	// +private
 	Database string
 	// +private
+	Databases []string
+	// +private
+	MemoryMb int
+	// +private
+	AuthPlugin string
+	// +private
+	ReadyTimeout int
+	// +private
 	Ctr *dagger.Container
 	// +private
 	Svc *dagger.Service
@@ -31,21 +46,136 @@ func New(
 	// Database name to create
 	// +default="test_db"
 	database string,
-) *Mysql {
+	// Additional databases to create on boot, alongside the main database
+	// +optional
+	databases []string,
+	// Memory budget for the server in megabytes. Dagger can't limit container resources, so this
+	// instead sizes the InnoDB buffer pool to half the budget via a generated config file
+	// +optional
+	memoryMb int,
+	// Seconds to wait for the server to accept connections before failing
+	// +default=60
+	readyTimeout int,
+	// Default authentication plugin for users (e.g. mysql_native_password for legacy clients),
+	// otherwise the image default. Set via default_authentication_plugin before 8.4 and
+	// authentication_policy from 8.4, which also enables mysql_native_password as it is off by
+	// default there. MySQL 9 removed mysql_native_password
+	// +optional
+	authPlugin string,
+) (*Mysql, error) {
+	if readyTimeout <= 0 {
+		return nil, fmt.Errorf("ready timeout must be positive")
+	}
+
+	if memoryMb < 0 {
+		return nil, fmt.Errorf("memory budget must not be negative")
+	}
+
+	if major, _ := assumedMajorMinor(version); major >= 9 && authPlugin == "mysql_native_password" {
+		return nil, fmt.Errorf("mysql_native_password is not available in MySQL %s", version)
+	}
+
+	for _, db := range databases {
+		if db == "" || strings.ContainsAny(db, "`/\\.") {
+			return nil, fmt.Errorf("invalid database name %q", db)
+		}
+	}
+
 	return &Mysql{
 		Version:      version,
 		RootPassword: rootPassword,
 		Database:     database,
-	}
+		Databases:    databases,
+		MemoryMb:     memoryMb,
+		AuthPlugin:   authPlugin,
+		ReadyTimeout: readyTimeout,
+	}, nil
 }
 
 // Base returns the base MySQL container
 func (m *Mysql) Base() *dagger.Container {
-	return dag.Container().
+	ctr := dag.Container().
 		From("mysql:"+m.Version).
 		WithEnvVariable("MYSQL_ROOT_PASSWORD", m.RootPassword).
 		WithEnvVariable("MYSQL_DATABASE", m.Database).
 		WithExposedPort(3306)
+
+	if len(m.Databases) > 0 {
+		ctr = ctr.WithNewFile("/docker-entrypoint-initdb.d/00-databases.sql", m.initScript())
+	}
+
+	if m.MemoryMb > 0 {
+		ctr = ctr.WithNewFile("/etc/mysql/conf.d/dagger-resources.cnf", m.resourceConfig())
+	}
+
+	if m.AuthPlugin != "" {
+		ctr = ctr.WithNewFile("/etc/mysql/conf.d/dagger-auth.cnf", m.authConfig())
+	}
+
+	return ctr
+}
+
+// authConfig returns a MySQL option file making the configured plugin the default for new users,
+// including the root user the entrypoint creates on first boot
+func (m *Mysql) authConfig() string {
+	if usesAuthenticationPolicy(m.Version) {
+		config := fmt.Sprintf("[mysqld]\nauthentication_policy=%s,,\n", m.AuthPlugin)
+		if m.AuthPlugin == "mysql_native_password" {
+			config += "mysql_native_password=ON\n"
+		}
+
+		return config
+	}
+
+	return fmt.Sprintf("[mysqld]\ndefault_authentication_plugin=%s\n", m.AuthPlugin)
+}
+
+// usesAuthenticationPolicy reports whether the version configures the default plugin through
+// authentication_policy, which replaced default_authentication_plugin in 8.4
+func usesAuthenticationPolicy(version string) bool {
+	major, minor := assumedMajorMinor(version)
+
+	return major > 8 || major == 8 && minor >= 4
+}
+
+// assumedMajorMinor returns the major and minor version of an image tag. Tags without a version
+// such as latest or innovation track the newest release, so they are assumed to be MySQL 9
+func assumedMajorMinor(version string) (int, int) {
+	major, minor, ok := parseMajorMinor(version)
+	if !ok {
+		return 9, 0
+	}
+
+	return major, minor
+}
+
+// parseMajorMinor parses the leading major and optional minor version of an image tag such as
+// 8.0.36 or 8.4-oracle
+func parseMajorMinor(version string) (int, int, bool) {
+	matches := imageVersionPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return 0, 0, false
+	}
+
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+
+	return major, minor, true
+}
+
+// resourceConfig returns a MySQL option file sizing the server to the configured memory budget
+func (m *Mysql) resourceConfig() string {
+	return fmt.Sprintf("[mysqld]\ninnodb_buffer_pool_size=%dM\n", max(m.MemoryMb/2, 5))
+}
+
+// initScript returns the SQL that creates the additional databases on first boot
+func (m *Mysql) initScript() string {
+	var b strings.Builder
+	for _, db := range m.Databases {
+		fmt.Fprintf(&b, "CREATE DATABASE IF NOT EXISTS `%s`;\n", db)
+	}
+
+	return b.String()
 }
 
 // Service returns the MySQL service
@@ -68,13 +198,154 @@ func (m *Mysql) Client(ctx context.Context) *dagger.Container {
 	return dag.Container().
 		From("mysql:"+m.Version).
 		WithServiceBinding("db", m.Service(ctx)).
-		WithExec([]string{
-			"sh", "-c",
-			"until mysqladmin ping -h db --silent; do echo 'Waiting for MySQL...'; sleep 2; done",
-		})
+		WithExec([]string{"sh", "-c", readinessScript(m.ReadyTimeout)})
+}
+
+// readinessScript returns a shell script that pings the server with capped exponential backoff,
+// failing once the timeout in seconds has elapsed
+func readinessScript(timeout int) string {
+	return fmt.Sprintf(`start=$(date +%%s)
+delay=1
+until mysqladmin ping -h db --silent; do
+  elapsed=$(( $(date +%%s) - start ))
+  if [ "$elapsed" -ge %[1]d ]; then
+    echo "Timed out waiting for MySQL to accept connections after ${elapsed}s (timeout %[1]ds)" >&2
+    exit 1
+  fi
+  echo "Waiting for MySQL... (${elapsed}s elapsed)"
+  remaining=$(( %[1]d - elapsed ))
+  if [ "$delay" -gt "$remaining" ]; then delay=$remaining; fi
+  sleep "$delay"
+  delay=$(( delay * 2 ))
+  if [ "$delay" -gt 8 ]; then delay=8; fi
+done`, timeout)
+}
+
+// QueryScalar runs a query expected to return a single value against the configured database and
+// returns it trimmed
+func (m *Mysql) QueryScalar(ctx context.Context, sql string) (string, error) {
+	out, err := m.query(ctx, sql)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// QueryRows runs a query against the configured database and returns each row as a list of column values
+func (m *Mysql) QueryRows(ctx context.Context, sql string) ([][]string, error) {
+	out, err := m.query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRows(out), nil
+}
+
+// parseRows splits batch mode output into rows of tab-separated column values. NULL values are
+// returned as the string NULL, as the mysql client prints them
+func parseRows(out string) [][]string {
+	rows := make([][]string, 0)
+	for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+
+	return rows
+}
+
+// query runs SQL in batch mode without column names once the server is ready and returns the raw output
+func (m *Mysql) query(ctx context.Context, sql string) (string, error) {
+	out, err := m.session(ctx).
+		WithExec([]string{"mysql", "-h", "db", "-u", "root", "-N", "-B", "-e", sql, m.Database}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run query: %w", err)
+	}
+
+	return out, nil
+}
+
+// session returns a client authenticated as root. Commands change server state that Dagger can't see,
+// so the cache is busted to run them every time rather than reusing an earlier identical result
+func (m *Mysql) session(ctx context.Context) *dagger.Container {
+	return m.Client(ctx).
+		WithEnvVariable("MYSQL_PWD", m.RootPassword).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+}
+
+// WithFixtures loads every .sql file in the fixtures directory into the configured database, in
+// lexical order, e.g. 01-schema.sql before 02-data.sql
+func (m *Mysql) WithFixtures(
+	ctx context.Context,
+	// Directory of SQL fixture files
+	fixtures *dagger.Directory,
+) (*Mysql, error) {
+	_, err := m.session(ctx).
+		WithMountedDirectory("/fixtures", fixtures).
+		WithExec([]string{"sh", "-c", fixturesScript("/fixtures", m.Database)}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fixtures: %w", err)
+	}
+
+	return m, nil
+}
+
+// fixturesScript returns a shell script loading the .sql files in dir into the database, stopping
+// at the first file that fails. Globs expand in lexical order
+func fixturesScript(dir string, database string) string {
+	return fmt.Sprintf(`set -e
+for f in %s/*.sql; do
+  [ -e "$f" ] || continue
+  echo "Loading $f"
+  mysql -h db -u root %s < "$f"
+done`, dir, database)
+}
+
+// Reset drops and recreates the configured database, e.g. to clear state between test cases
+func (m *Mysql) Reset(ctx context.Context) (*Mysql, error) {
+	sql := fmt.Sprintf("DROP DATABASE IF EXISTS `%[1]s`; CREATE DATABASE `%[1]s`;", m.Database)
+
+	_, err := m.session(ctx).
+		WithExec([]string{"mysql", "-h", "db", "-u", "root", "-e", sql}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset database %s: %w", m.Database, err)
+	}
+
+	return m, nil
 }
 
 // ConnectionString returns the connection string for connecting to MySQL from a bound service
 func (m *Mysql) ConnectionString() string {
-	return fmt.Sprintf("mysql://root:%s@db:3306/%s", m.RootPassword, m.Database)
+	return m.ConnectionStringFor(m.Database)
+}
+
+// ConnectionStringFor returns the connection string for a specific database on the bound service
+func (m *Mysql) ConnectionStringFor(db string) string {
+	return fmt.Sprintf("mysql://root:%s@db:3306/%s", m.RootPassword, db)
+}
+
+// Stop cleanly shuts down the MySQL server and stops the service. This is best-effort: Dagger
+// manages service lifecycles itself and will also stop the service once nothing depends on it
+func (m *Mysql) Stop(ctx context.Context) error {
+	svc := m.Service(ctx)
+
+	// mysqladmin shutdown flushes tables and stops the server so data files aren't left needing recovery
+	_, err := m.session(ctx).
+		WithExec([]string{"mysqladmin", "-h", "db", "-u", "root", "shutdown"}).
+		Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to shut down mysql: %w", err)
+	}
+
+	if _, err := svc.Stop(ctx); err != nil {
+		return fmt.Errorf("failed to stop mysql service: %w", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInitScript(t *testing.T) {
+	m, err := New("8.0", "root", "test_db", []string{"orders", "users"}, 0, 60, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "CREATE DATABASE IF NOT EXISTS `orders`;\nCREATE DATABASE IF NOT EXISTS `users`;\n"
+	if got := m.initScript(); got != want {
+		t.Errorf("initScript() = %q, want %q", got, want)
+	}
+
+	for _, db := range []string{"", "bad`name", "a.b", "../etc"} {
+		if _, err := New("8.0", "root", "test_db", []string{db}, 0, 60, ""); err == nil {
+			t.Errorf("New() with database %q succeeded, want an error", db)
+		}
+	}
+}
+
+func TestResourceConfig(t *testing.T) {
+	tests := []struct {
+		memoryMb int
+		want     string
+	}{
+		{1024, "[mysqld]\ninnodb_buffer_pool_size=512M\n"},
+		{4, "[mysqld]\ninnodb_buffer_pool_size=5M\n"},
+	}
+
+	for _, tt := range tests {
+		m := &Mysql{MemoryMb: tt.memoryMb}
+		if got := m.resourceConfig(); got != tt.want {
+			t.Errorf("resourceConfig() with %dMB = %q, want %q", tt.memoryMb, got, tt.want)
+		}
+	}
+
+	if _, err := New("8.0", "root", "test_db", nil, -1, 60, ""); err == nil {
+		t.Error("New() with a negative memory budget succeeded, want an error")
+	}
+}
+
+func TestAuthConfig(t *testing.T) {
+	tests := []struct {
+		version    string
+		authPlugin string
+		want       string
+	}{
+		{"8.0", "mysql_native_password", "[mysqld]\ndefault_authentication_plugin=mysql_native_password\n"},
+		{"8.0.36", "caching_sha2_password", "[mysqld]\ndefault_authentication_plugin=caching_sha2_password\n"},
+		{"8.4", "mysql_native_password", "[mysqld]\nauthentication_policy=mysql_native_password,,\nmysql_native_password=ON\n"},
+		{"8.4-oracle", "caching_sha2_password", "[mysqld]\nauthentication_policy=caching_sha2_password,,\n"},
+		{"latest", "caching_sha2_password", "[mysqld]\nauthentication_policy=caching_sha2_password,,\n"},
+		{"9.1", "caching_sha2_password", "[mysqld]\nauthentication_policy=caching_sha2_password,,\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version+" "+tt.authPlugin, func(t *testing.T) {
+			m, err := New(tt.version, "root", "test_db", nil, 0, 60, tt.authPlugin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.authConfig(); got != tt.want {
+				t.Errorf("authConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, version := range []string{"9.1", "latest", "innovation"} {
+		if _, err := New(version, "root", "test_db", nil, 0, 60, "mysql_native_password"); err == nil {
+			t.Errorf("New() with mysql_native_password on MySQL %s succeeded, want an error", version)
+		}
+	}
+}
+
+func TestReadinessScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	tests := []struct {
+		name         string
+		failures     int
+		timeout      int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"ready immediately", 0, 10, false, 1},
+		{"waits for the server", 1, 10, false, 2},
+		{"times out", 100, 1, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			counter := filepath.Join(dir, "attempts")
+
+			// The stub mysqladmin fails the given number of pings before succeeding
+			script := fmt.Sprintf(`n=$(cat %[1]s 2>/dev/null || echo 0)
+echo $((n + 1)) > %[1]s
+[ "$n" -ge %[2]d ]
+`, counter, tt.failures)
+
+			if err := os.WriteFile(filepath.Join(dir, "mysqladmin"), []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("sh", "-c", readinessScript(tt.timeout))
+			cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			out, err := cmd.CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readiness script error = %v, want error %t\n%s", err, tt.wantErr, out)
+			}
+
+			if tt.wantErr && !strings.Contains(string(out), "Timed out waiting for MySQL") {
+				t.Errorf("readiness script output = %q, want a timeout message", out)
+			}
+
+			attempts, err := os.ReadFile(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(string(attempts)); got != fmt.Sprint(tt.wantAttempts) {
+				t.Errorf("readiness script pinged %s times, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestParseRows(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want [][]string
+	}{
+		{"empty result", "", [][]string{}},
+		{"single value", "42\n", [][]string{{"42"}}},
+		{"tab separated columns", "1\talice\n2\tbob\n", [][]string{{"1", "alice"}, {"2", "bob"}}},
+		{"NULL and empty columns", "1\tNULL\t\n", [][]string{{"1", "NULL", ""}}},
+		{"values with spaces", "1\tAda Lovelace\n", [][]string{{"1", "Ada Lovelace"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRows(tt.out)
+			if !slices.EqualFunc(got, tt.want, slices.Equal[[]string]) {
+				t.Errorf("parseRows() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixturesScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	fixtures := filepath.Join(dir, "fixtures")
+	loaded := filepath.Join(dir, "loaded")
+
+	for _, d := range []string{bin, fixtures} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stub mysql records its database argument and the SQL it reads, failing on a bad statement
+	stub := fmt.Sprintf(`sql=$(cat)
+echo "${5}: $sql" >> %s
+[ "$sql" != "BAD" ]
+`, loaded)
+	if err := os.WriteFile(filepath.Join(bin, "mysql"), []byte(stub), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() (string, error) {
+		cmd := exec.Command("sh", "-c", fixturesScript(fixtures, "test_db"))
+		cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		out, err := cmd.CombinedOutput()
+
+		return string(out), err
+	}
+
+	if out, err := run(); err != nil {
+		t.Fatalf("fixtures script with no fixtures error = %v\n%s", err, out)
+	}
+
+	files := map[string]string{"02-data.sql": "INSERT", "01-schema.sql": "CREATE", "notes.txt": "IGNORED"}
+	for name, sql := range files {
+		if err := os.WriteFile(filepath.Join(fixtures, name), []byte(sql), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := run(); err != nil {
+		t.Fatalf("fixtures script error = %v\n%s", err, out)
+	}
+
+	got, err := os.ReadFile(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "test_db: CREATE\ntest_db: INSERT\n"; string(got) != want {
+		t.Errorf("fixtures script loaded %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(fixtures, "03-broken.sql"), []byte("BAD"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := run(); err == nil {
+		t.Errorf("fixtures script with a failing fixture succeeded\n%s", out)
+	}
+}
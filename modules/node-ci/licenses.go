@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// licenseIDPattern matches the SPDX identifiers in a license expression such as "(MIT OR GPL-3.0)"
+var licenseIDPattern = regexp.MustCompile(`[A-Za-z0-9][A-Za-z0-9.+-]*`)
+
+// dependencyLicense is a production dependency and the license it declares
+type dependencyLicense struct {
+	Package string
+	License string
+}
+
+// LicenseCheck reports the license of every production dependency, one per line, failing if any
+// uses a disallowed license or, with an allowlist, one not on it. Licenses are SPDX identifiers
+// matched with any version suffix, so GPL matches GPL-2.0 and GPL-3.0-only but not LGPL-3.0.
+// Every identifier in an expression is checked, so MIT OR GPL-3.0 fails when GPL is disallowed
+func (m *NodeCi) LicenseCheck(
+	ctx context.Context,
+	// Licenses no dependency may use (e.g. GPL, AGPL)
+	// +optional
+	disallowed []string,
+	// Licenses dependencies must use, flagging any others including unknown licenses
+	// +optional
+	allowlist []string,
+) (string, error) {
+	if len(disallowed) == 0 && len(allowlist) == 0 {
+		return "", fmt.Errorf("no licenses to check, set disallowed and/or allowlist")
+	}
+
+	// license-checker walks node_modules, which pnpm nests in its virtual store, so pnpm's own
+	// report is used instead. Yarn Plug'n'Play installs have no node_modules to scan
+	var args []string
+	if m.PackageManager == PNPM {
+		args = []string{"pnpm", "licenses", "list", "--prod", "--json"}
+	} else {
+		args = []string{"npx", "--yes", "license-checker", "--production", "--json"}
+	}
+
+	out, err := m.getContainer(ctx).
+		WithExec(args).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list dependency licenses: %w", err)
+	}
+
+	var deps []dependencyLicense
+	if m.PackageManager == PNPM {
+		deps, err = parsePnpmLicenses(out)
+	} else {
+		deps, err = parseLicenseChecker(out)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var report, violations []string
+	for _, dep := range deps {
+		line := dep.Package + ": " + dep.License
+		report = append(report, line)
+
+		if !licenseAllowed(dep.License, disallowed, allowlist) {
+			violations = append(violations, line)
+		}
+	}
+
+	if len(violations) > 0 {
+		return strings.Join(report, "\n"), fmt.Errorf("%d dependencies use disallowed licenses:\n%s", len(violations), strings.Join(violations, "\n"))
+	}
+
+	return strings.Join(report, "\n"), nil
+}
+
+// parseLicenseChecker parses license-checker JSON output, keyed by name@version, skipping the
+// project itself which it reports alongside its dependencies
+func parseLicenseChecker(output string) ([]dependencyLicense, error) {
+	var packages map[string]struct {
+		Licenses any    `json:"licenses"`
+		Path     string `json:"path"`
+	}
+
+	if err := json.Unmarshal([]byte(output), &packages); err != nil {
+		return nil, fmt.Errorf("failed to parse license-checker output: %w", err)
+	}
+
+	deps := make([]dependencyLicense, 0, len(packages))
+	for pkg, info := range packages {
+		if !strings.Contains(info.Path, "node_modules") {
+			continue
+		}
+
+		// Packages with several license entries report a list, treated as either license applying
+		license := "UNKNOWN"
+		switch v := info.Licenses.(type) {
+		case string:
+			license = v
+		case []any:
+			var licenses []string
+			for _, l := range v {
+				licenses = append(licenses, fmt.Sprint(l))
+			}
+			license = strings.Join(licenses, " OR ")
+		}
+
+		deps = append(deps, dependencyLicense{Package: pkg, License: license})
+	}
+
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Package < deps[j].Package })
+	return deps, nil
+}
+
+// parsePnpmLicenses parses pnpm licenses list JSON output, which groups packages by license. pnpm 9
+// lists every installed version of a package in versions, while pnpm 8 reports a single version
+func parsePnpmLicenses(output string) ([]dependencyLicense, error) {
+	var licenses map[string][]struct {
+		Name     string   `json:"name"`
+		Version  string   `json:"version"`
+		Versions []string `json:"versions"`
+	}
+
+	if err := json.Unmarshal([]byte(output), &licenses); err != nil {
+		return nil, fmt.Errorf("failed to parse pnpm licenses output: %w", err)
+	}
+
+	var deps []dependencyLicense
+	listed := 0
+	for license, packages := range licenses {
+		listed += len(packages)
+
+		for _, pkg := range packages {
+			versions := pkg.Versions
+			if len(versions) == 0 && pkg.Version != "" {
+				versions = []string{pkg.Version}
+			}
+
+			for _, version := range versions {
+				deps = append(deps, dependencyLicense{Package: pkg.Name + "@" + version, License: license})
+			}
+		}
+	}
+
+	// An unrecognised report shape would otherwise pass the check without checking anything
+	if listed > 0 && len(deps) == 0 {
+		return nil, fmt.Errorf("failed to parse pnpm licenses output: no package versions found in %d packages", listed)
+	}
+
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Package < deps[j].Package })
+	return deps, nil
+}
+
+// licenseAllowed reports whether no identifier in the license expression is disallowed and, with
+// an allowlist, every identifier is on it
+func licenseAllowed(license string, disallowed []string, allowlist []string) bool {
+	var ids []string
+	for _, id := range licenseIDPattern.FindAllString(license, -1) {
+		switch strings.ToUpper(id) {
+		case "OR", "AND", "WITH":
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return len(allowlist) == 0
+	}
+
+	for _, id := range ids {
+		if slices.ContainsFunc(disallowed, func(l string) bool { return licenseMatches(id, l) }) {
+			return false
+		}
+
+		if len(allowlist) > 0 && !slices.ContainsFunc(allowlist, func(l string) bool { return licenseMatches(id, l) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// licenseMatches reports whether an SPDX identifier is the license or one of its versions, e.g.
+// GPL-3.0-or-later for GPL
+func licenseMatches(id string, license string) bool {
+	id, license = strings.ToUpper(id), strings.ToUpper(license)
+	return id == license || strings.HasPrefix(id, license+"-")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLicenseAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		license    string
+		disallowed []string
+		allowlist  []string
+		want       bool
+	}{
+		{"allowed", "MIT", []string{"GPL"}, nil, true},
+		{"disallowed version", "GPL-3.0-only", []string{"GPL"}, nil, false},
+		{"prefix of another license", "LGPL-3.0", []string{"GPL"}, nil, true},
+		{"any identifier in an expression", "(MIT OR GPL-3.0)", []string{"GPL"}, nil, false},
+		{"case insensitive", "gpl-2.0", []string{"GPL"}, nil, false},
+		{"on the allowlist", "Apache-2.0", nil, []string{"MIT", "Apache"}, true},
+		{"off the allowlist", "ISC", nil, []string{"MIT"}, false},
+		{"expression partly off the allowlist", "MIT AND BSD-3-Clause", nil, []string{"MIT"}, false},
+		{"unknown with an allowlist", "", nil, []string{"MIT"}, false},
+		{"unknown without an allowlist", "", []string{"GPL"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := licenseAllowed(tt.license, tt.disallowed, tt.allowlist); got != tt.want {
+				t.Errorf("licenseAllowed() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLicenseChecker(t *testing.T) {
+	output := `{
+  "app@1.0.0": {"licenses": "MIT", "path": "/app"},
+  "left-pad@1.3.0": {"licenses": "WTFPL", "path": "/app/node_modules/left-pad"},
+  "dual@2.0.0": {"licenses": ["MIT", "GPL-2.0"], "path": "/app/node_modules/dual"},
+  "mystery@0.1.0": {"path": "/app/node_modules/mystery"}
+}`
+
+	got, err := parseLicenseChecker(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The project itself is left out
+	want := []dependencyLicense{
+		{Package: "dual@2.0.0", License: "MIT OR GPL-2.0"},
+		{Package: "left-pad@1.3.0", License: "WTFPL"},
+		{Package: "mystery@0.1.0", License: "UNKNOWN"},
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("parseLicenseChecker() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePnpmLicenses(t *testing.T) {
+	output := `{
+  "MIT": [{"name": "react", "versions": ["18.2.0", "17.0.2"]}],
+  "GPL-3.0": [{"name": "readline-gpl", "versions": ["1.0.0"]}]
+}`
+
+	got, err := parsePnpmLicenses(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []dependencyLicense{
+		{Package: "react@17.0.2", License: "MIT"},
+		{Package: "react@18.2.0", License: "MIT"},
+		{Package: "readline-gpl@1.0.0", License: "GPL-3.0"},
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("parsePnpmLicenses() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePnpmLicensesVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []dependencyLicense
+		wantErr bool
+	}{
+		{
+			"pnpm 8 single version",
+			`{"MIT": [{"name": "react", "version": "18.2.0", "path": "/app/node_modules/.pnpm/react@18.2.0"}]}`,
+			[]dependencyLicense{{Package: "react@18.2.0", License: "MIT"}},
+			false,
+		},
+		{"no dependencies", `{}`, nil, false},
+		{"packages without versions", `{"MIT": [{"name": "react"}]}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePnpmLicenses(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePnpmLicenses() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parsePnpmLicenses() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"dagger/node-ci/internal/dagger"
+)
+
+// eslintCommand runs the project's own eslint if it is a dependency, falling back to npx
+const eslintCommand = `run_eslint() { if [ -x node_modules/.bin/eslint ]; then node_modules/.bin/eslint "$@"; else npx --yes eslint "$@"; fi; }; run_eslint`
+
+// eslintResult is the subset of an ESLint JSON formatter entry needed to count problems
+type eslintResult struct {
+	FilePath     string `json:"filePath"`
+	ErrorCount   int    `json:"errorCount"`
+	WarningCount int    `json:"warningCount"`
+}
+
+// LintJSON runs eslint with the JSON formatter and returns its machine-readable results, with an
+// error if there are lint errors. Warnings alone don't fail
+func (m *NodeCi) LintJSON(ctx context.Context) (string, error) {
+	ctr := m.getContainer(ctx).
+		WithExec([]string{"sh", "-c", eslintCommand + " --format json ."}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run eslint: %w", err)
+	}
+
+	// eslint exits 1 for lint errors and 2 for configuration or crash errors, which produce no JSON
+	if exitCode > 1 {
+		out, _ := ctr.CombinedOutput(ctx)
+		return "", fmt.Errorf("eslint failed to run:\n%s", out)
+	}
+
+	out, err := ctr.Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read eslint output: %w", err)
+	}
+
+	errors, warnings, err := countLintProblems(out)
+	if err != nil {
+		return out, err
+	}
+
+	if errors > 0 {
+		return out, fmt.Errorf("lint found %d errors and %d warnings", errors, warnings)
+	}
+
+	return out, nil
+}
+
+// countLintProblems returns the total errors and warnings in ESLint JSON formatter output
+func countLintProblems(output string) (int, int, error) {
+	var results []eslintResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse eslint output: %w", err)
+	}
+
+	var errors, warnings int
+	for _, result := range results {
+		errors += result.ErrorCount
+		warnings += result.WarningCount
+	}
+
+	return errors, warnings, nil
+}
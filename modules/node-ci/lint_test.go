@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCountLintProblems(t *testing.T) {
+	output := `[
+  {"filePath": "/app/src/index.js", "errorCount": 2, "warningCount": 1},
+  {"filePath": "/app/src/util.js", "errorCount": 0, "warningCount": 3},
+  {"filePath": "/app/src/clean.js", "errorCount": 0, "warningCount": 0}
+]`
+
+	errors, warnings, err := countLintProblems(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errors != 2 || warnings != 4 {
+		t.Errorf("countLintProblems() = %d errors, %d warnings, want 2 errors, 4 warnings", errors, warnings)
+	}
+
+	if _, _, err := countLintProblems("Oops! Something went wrong"); err == nil {
+		t.Error("countLintProblems() with non-JSON output succeeded, want an error")
+	}
+}
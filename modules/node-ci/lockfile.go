@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger/node-ci/internal/dagger"
+)
+
+// DependencyChange describes a dependency that differs between two lockfiles
+type DependencyChange struct {
+	// Package name
+	Name string
+	// Version(s) in the previous lockfile, empty when added
+	OldVersion string
+	// Version(s) in the current lockfile, empty when removed
+	NewVersion string
+	// One of "added", "removed" or "bumped"
+	ChangeType string
+}
+
+// LockfileDiff compares the source lockfile against a previous revision and returns the dependency
+// changes. With a workspace set, the package's own lockfile is used if it has one, otherwise the
+// workspace root lockfile dependencies are installed from
+func (m *NodeCi) LockfileDiff(
+	ctx context.Context,
+	// The previous lockfile to compare against
+	previous *dagger.File,
+) ([]*DependencyChange, error) {
+	lockfile := m.getLockfile()
+
+	if m.Workspace != "" {
+		path := filepath.Join(m.Workspace, lockfile)
+
+		exists, err := m.Source.Exists(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for %s: %w", path, err)
+		}
+
+		if exists {
+			lockfile = path
+		}
+	}
+
+	current, err := m.Source.File(lockfile).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", lockfile, err)
+	}
+
+	old, err := previous.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read previous lockfile: %w", err)
+	}
+
+	oldDeps, err := m.parseLockfile(old)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse previous lockfile: %w", err)
+	}
+
+	newDeps, err := m.parseLockfile(current)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", lockfile, err)
+	}
+
+	return diffDependencies(oldDeps, newDeps), nil
+}
+
+// parseLockfile extracts package name -> resolved versions from the package manager's lockfile
+func (m *NodeCi) parseLockfile(contents string) (map[string][]string, error) {
+	switch m.PackageManager {
+	case Yarn:
+		return parseYarnLock(contents), nil
+	case PNPM:
+		return parsePnpmLock(contents), nil
+	case Bun:
+		return nil, fmt.Errorf("bun's binary lockfile can't be parsed")
+	default:
+		return parseNpmLock(contents)
+	}
+}
+
+// diffDependencies returns the changes between two dependency sets, sorted by name
+func diffDependencies(oldDeps, newDeps map[string][]string) []*DependencyChange {
+	changes := make([]*DependencyChange, 0)
+
+	for name, versions := range newDeps {
+		newVersion := joinVersions(versions)
+
+		oldVersions, ok := oldDeps[name]
+		if !ok {
+			changes = append(changes, &DependencyChange{Name: name, NewVersion: newVersion, ChangeType: "added"})
+			continue
+		}
+
+		if oldVersion := joinVersions(oldVersions); oldVersion != newVersion {
+			changes = append(changes, &DependencyChange{Name: name, OldVersion: oldVersion, NewVersion: newVersion, ChangeType: "bumped"})
+		}
+	}
+
+	for name, versions := range oldDeps {
+		if _, ok := newDeps[name]; !ok {
+			changes = append(changes, &DependencyChange{Name: name, OldVersion: joinVersions(versions), ChangeType: "removed"})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes
+}
+
+// joinVersions returns the unique versions in sorted order as a comma separated string
+func joinVersions(versions []string) string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(versions))
+
+	for _, v := range versions {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+
+	sort.Strings(unique)
+	return strings.Join(unique, ", ")
+}
+
+// parseNpmLock parses a package-lock.json, supporting both the v1 and v2/v3 formats
+func parseNpmLock(contents string) (map[string][]string, error) {
+	var lock struct {
+		Packages map[string]struct {
+			Version string `json:"version"`
+			Link    bool   `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}
+
+	if err := json.Unmarshal([]byte(contents), &lock); err != nil {
+		return nil, err
+	}
+
+	deps := make(map[string][]string)
+
+	if len(lock.Packages) > 0 {
+		for path, pkg := range lock.Packages {
+			idx := strings.LastIndex(path, "node_modules/")
+			if idx < 0 || pkg.Link || pkg.Version == "" {
+				continue
+			}
+
+			name := path[idx+len("node_modules/"):]
+			deps[name] = append(deps[name], pkg.Version)
+		}
+
+		return deps, nil
+	}
+
+	for name, dep := range lock.Dependencies {
+		deps[name] = append(deps[name], dep.Version)
+	}
+
+	return deps, nil
+}
+
+// parseYarnLock parses a yarn.lock in either the classic (v1) or berry format
+func parseYarnLock(contents string) map[string][]string {
+	deps := make(map[string][]string)
+	var names []string
+
+	for _, line := range strings.Split(contents, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+
+		// Entry headers are unindented, e.g. `"lodash@^4.0.0", lodash@^4.17.0:`
+		if !strings.HasPrefix(line, " ") {
+			names = names[:0]
+			for _, spec := range strings.Split(strings.TrimSuffix(trimmed, ":"), ",") {
+				spec = strings.Trim(strings.TrimSpace(spec), `"`)
+				if name := packageNameFromSpec(spec); name != "" && name != "__metadata" {
+					names = append(names, name)
+				}
+			}
+
+			continue
+		}
+
+		if !strings.HasPrefix(trimmed, "version") || len(names) == 0 {
+			continue
+		}
+
+		version := strings.TrimSpace(strings.TrimPrefix(trimmed, "version"))
+		version = strings.Trim(strings.TrimPrefix(version, ":"), ` "`)
+
+		// All specs in a header resolve to the same version, so record it once
+		deps[names[0]] = append(deps[names[0]], version)
+		names = names[:0]
+	}
+
+	return deps
+}
+
+// parsePnpmLock parses the packages section of a pnpm-lock.yaml (lockfile v5 to v9)
+func parsePnpmLock(contents string) map[string][]string {
+	deps := make(map[string][]string)
+	inPackages := false
+
+	for _, line := range strings.Split(contents, "\n") {
+		// Entries are separated by blank lines, which don't end the section
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, " ") {
+			inPackages = strings.TrimSpace(line) == "packages:"
+			continue
+		}
+
+		// Package keys are indented exactly two spaces, e.g. `  /lodash@4.17.21:` or `  lodash@4.17.21:`
+		if !inPackages || strings.HasPrefix(line, "   ") {
+			continue
+		}
+
+		key := strings.Trim(strings.TrimSuffix(strings.TrimSpace(line), ":"), `'"`)
+		key = strings.TrimPrefix(key, "/")
+
+		// Strip peer dependency suffixes such as `(react@18.2.0)` or `_react@18.2.0`
+		if idx := strings.Index(key, "("); idx >= 0 {
+			key = key[:idx]
+		}
+
+		name, version := splitPnpmKey(key)
+		if name != "" && version != "" {
+			deps[name] = append(deps[name], version)
+		}
+	}
+
+	return deps
+}
+
+// splitPnpmKey splits a pnpm package key into name and version, handling both the
+// `name@version` (v6+) and `name/version` (v5) forms. v5 peer suffixes such as
+// `_supports-color@8.0.0` contain an @, so the v5 version segment is checked for first
+func splitPnpmKey(key string) (string, string) {
+	if idx := strings.LastIndex(key, "/"); idx > 0 {
+		version, _, _ := strings.Cut(key[idx+1:], "_")
+		if version != "" && version[0] >= '0' && version[0] <= '9' && !strings.Contains(version, "@") {
+			return key[:idx], version
+		}
+	}
+
+	if idx := strings.LastIndex(key, "@"); idx > 0 {
+		version, _, _ := strings.Cut(key[idx+1:], "_")
+		return key[:idx], version
+	}
+
+	return "", ""
+}
+
+// packageNameFromSpec returns the package name from a dependency spec such as `@scope/pkg@^1.0.0`
+func packageNameFromSpec(spec string) string {
+	if idx := strings.LastIndex(spec, "@"); idx > 0 {
+		return spec[:idx]
+	}
+
+	return spec
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestLockfileDiffNpm(t *testing.T) {
+	before := `{
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"name": "app"},
+    "node_modules/lodash": {"version": "4.17.20"},
+    "node_modules/left-pad": {"version": "1.3.0"},
+    "node_modules/@scope/util": {"version": "1.0.0"},
+    "packages/web": {"version": "0.1.0"},
+    "node_modules/web": {"link": true}
+  }
+}`
+
+	after := `{
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"name": "app"},
+    "node_modules/lodash": {"version": "4.17.21"},
+    "node_modules/@scope/util": {"version": "1.0.0"},
+    "node_modules/@scope/util/node_modules/lodash": {"version": "3.10.1"},
+    "node_modules/react": {"version": "18.2.0"}
+  }
+}`
+
+	want := []DependencyChange{
+		{Name: "left-pad", OldVersion: "1.3.0", ChangeType: "removed"},
+		{Name: "lodash", OldVersion: "4.17.20", NewVersion: "3.10.1, 4.17.21", ChangeType: "bumped"},
+		{Name: "react", NewVersion: "18.2.0", ChangeType: "added"},
+	}
+
+	assertLockfileDiff(t, NPM, before, after, want)
+}
+
+func TestLockfileDiffNpmV1(t *testing.T) {
+	before := `{"lockfileVersion": 1, "dependencies": {"lodash": {"version": "4.17.20"}}}`
+	after := `{"lockfileVersion": 1, "dependencies": {"lodash": {"version": "4.17.21"}}}`
+
+	want := []DependencyChange{
+		{Name: "lodash", OldVersion: "4.17.20", NewVersion: "4.17.21", ChangeType: "bumped"},
+	}
+
+	assertLockfileDiff(t, NPM, before, after, want)
+}
+
+func TestLockfileDiffPnpm(t *testing.T) {
+	before := `lockfileVersion: '9.0'
+
+importers:
+  .:
+    dependencies:
+      react:
+        specifier: ^18.0.0
+        version: 18.2.0
+
+packages:
+
+  react@18.2.0:
+    resolution: {integrity: sha512-abc}
+
+  '@types/node@20.1.0':
+    resolution: {integrity: sha512-def}
+
+  left-pad@1.3.0:
+    resolution: {integrity: sha512-ghi}
+
+snapshots:
+  react@18.2.0: {}
+`
+
+	after := `lockfileVersion: '9.0'
+
+packages:
+  react@18.3.1:
+    resolution: {integrity: sha512-abc}
+  '@types/node@20.1.0':
+    resolution: {integrity: sha512-def}
+  react-dom@18.3.1(react@18.3.1):
+    resolution: {integrity: sha512-jkl}
+`
+
+	want := []DependencyChange{
+		{Name: "left-pad", OldVersion: "1.3.0", ChangeType: "removed"},
+		{Name: "react", OldVersion: "18.2.0", NewVersion: "18.3.1", ChangeType: "bumped"},
+		{Name: "react-dom", NewVersion: "18.3.1", ChangeType: "added"},
+	}
+
+	assertLockfileDiff(t, PNPM, before, after, want)
+}
+
+func TestParsePnpmLockV5(t *testing.T) {
+	contents := `lockfileVersion: 5.4
+
+packages:
+
+  /lodash/4.17.21:
+    resolution: {integrity: sha512-abc}
+
+  /@babel/core/7.22.0_supports-color@8.0.0:
+    resolution: {integrity: sha512-def}
+`
+
+	want := map[string][]string{
+		"lodash":      {"4.17.21"},
+		"@babel/core": {"7.22.0"},
+	}
+
+	if got := parsePnpmLock(contents); !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("parsePnpmLock() = %v, want %v", got, want)
+	}
+}
+
+func TestSplitPnpmKey(t *testing.T) {
+	tests := []struct {
+		key         string
+		wantName    string
+		wantVersion string
+	}{
+		{"lodash@4.17.21", "lodash", "4.17.21"},
+		{"@types/node@20.1.0", "@types/node", "20.1.0"},
+		{"@scope/3d-lib@1.0.0", "@scope/3d-lib", "1.0.0"},
+		{"lodash/4.17.21", "lodash", "4.17.21"},
+		{"@babel/core/7.22.0_supports-color@8.0.0", "@babel/core", "7.22.0"},
+		{"lodash", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			name, version := splitPnpmKey(tt.key)
+			if name != tt.wantName || version != tt.wantVersion {
+				t.Errorf("splitPnpmKey() = %q, %q, want %q, %q", name, version, tt.wantName, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestParseYarnLock(t *testing.T) {
+	classic := `# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.
+# yarn lockfile v1
+
+
+"@babel/code-frame@^7.0.0", "@babel/code-frame@^7.22.0":
+  version "7.22.13"
+  resolved "https://registry.yarnpkg.com/@babel/code-frame/-/code-frame-7.22.13.tgz"
+
+lodash@^4.17.20:
+  version "4.17.21"
+`
+
+	berry := `__metadata:
+  version: 6
+
+"lodash@npm:^4.17.20, lodash@npm:^4.17.21":
+  version: 4.17.21
+  resolution: "lodash@npm:4.17.21"
+
+"@babel/core@npm:^7.22.0":
+  version: 7.22.5
+  resolution: "@babel/core@npm:7.22.5"
+`
+
+	tests := []struct {
+		name     string
+		contents string
+		want     map[string][]string
+	}{
+		{"classic", classic, map[string][]string{"@babel/code-frame": {"7.22.13"}, "lodash": {"4.17.21"}}},
+		{"berry", berry, map[string][]string{"@babel/core": {"7.22.5"}, "lodash": {"4.17.21"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseYarnLock(tt.contents); !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("parseYarnLock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// assertLockfileDiff checks the dependency changes between two lockfiles of the package manager
+func assertLockfileDiff(t *testing.T, manager PackageManager, before, after string, want []DependencyChange) {
+	t.Helper()
+
+	m := &NodeCi{PackageManager: manager}
+
+	oldDeps, err := m.parseLockfile(before)
+	if err != nil {
+		t.Fatalf("failed to parse previous lockfile: %v", err)
+	}
+
+	newDeps, err := m.parseLockfile(after)
+	if err != nil {
+		t.Fatalf("failed to parse current lockfile: %v", err)
+	}
+
+	changes := diffDependencies(oldDeps, newDeps)
+
+	got := make([]DependencyChange, 0, len(changes))
+	for _, change := range changes {
+		got = append(got, *change)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("diffDependencies() = %+v, want %+v", got, want)
+	}
+}
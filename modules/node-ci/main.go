@@ -3,21 +3,44 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"dagger/node-ci/internal/dagger"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // NodeCi module for Node.js CI tasks
 type NodeCi struct {
+	// +private
+	BaseImage string
+	// +private
+	CaCert *dagger.File
+	// +private
+	ContentCacheKey bool
 	// +private
 	NodeVersion string
 	// +private
+	Npmrc *dagger.Secret
+	// +private
 	PackageManager PackageManager
 	// +private
+	PackageManagerVersion string
+	// +private
+	DeclaredPackageManager string
+	// +private
+	UseCorepack bool
+	// +private
 	Source *dagger.Directory
 	// +private
+	Workspace string
+	// +private
 	Ctr *dagger.Container
 }
 
@@ -27,45 +50,458 @@ const (
 	NPM  PackageManager = "npm"
 	Yarn PackageManager = "yarn"
 	PNPM PackageManager = "pnpm"
+	Bun  PackageManager = "bun"
+	// Auto detects the package manager from package.json or the lockfile present
+	Auto PackageManager = "auto"
 )
 
+const (
+	defaultInstallRetries    = 2
+	defaultInstallRetryDelay = 5
+
+	nextCachePath = ".next/cache"
+
+	// autoNodeVersion detects the Node version from the source, falling back to defaultNodeVersion
+	autoNodeVersion    = "auto"
+	defaultNodeVersion = "20"
+
+	caCertPath     = "/usr/local/share/ca-certificates/custom-ca.crt"
+	systemCABundle = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// prettierCommand runs the project's own prettier if it is a dependency, falling back to npx
+const prettierCommand = `run_prettier() { if [ -x node_modules/.bin/prettier ]; then node_modules/.bin/prettier "$@"; else npx --yes prettier "$@"; fi; }; run_prettier`
+
+// tscCommand runs the project's own TypeScript compiler if it is a dependency, falling back to npx
+const tscCommand = `run_tsc() { if [ -x node_modules/.bin/tsc ]; then node_modules/.bin/tsc "$@"; else npx --yes -p typescript tsc "$@"; fi; }; run_tsc`
+
+// nodeVersionPattern matches a major version or release codename usable in a node image tag
+var nodeVersionPattern = regexp.MustCompile(`^(\d+|[a-z]+)$`)
+
+// lockfileErrorPattern matches install failures caused by an out of date or invalid lockfile,
+// which fail identically on every attempt and so are not retried
+const lockfileErrorPattern = "can only install packages when your package.json and package-lock.json|" +
+	"Missing: .* from lock file|lockfile needs to be updated|ERR_PNPM_OUTDATED_LOCKFILE|" +
+	"ERR_PNPM_LOCKFILE|YN0028|lockfile had changes, but lockfile is frozen"
+
 func New(
+	ctx context.Context,
 	// The source code directory
 	// +ignore=["**/node_modules"]
 	source *dagger.Directory,
-	// The Node version to use
+	// The Node version to use. "auto" (or empty) reads .nvmrc, then the engines.node field of
+	// package.json, falling back to the default Node version
 	// +default="20"
 	nodeVersion string,
-	// The package manager to use (npm, yarn, pnpm)
-	// +default="npm"
+	// The package manager to use (npm, yarn, pnpm, bun). "auto" uses the packageManager field of
+	// package.json, then the lockfile present, falling back to npm
+	// +default="auto"
 	packageManager PackageManager,
-) *NodeCi {
+	// Key the package manager cache volume by the lockfile's content hash. Identical dependency
+	// sets share a cache and distinct ones stay isolated, at the cost of more storage and no
+	// partial reuse when a single dependency changes
+	// +optional
+	contentCacheKey bool,
+	// A custom CA certificate in PEM format to trust, e.g. for a TLS-inspecting proxy
+	// +optional
+	caCert *dagger.File,
+	// Version of the package manager to install globally (e.g. 8.15.0), instead of using Corepack.
+	// An unknown version fails with npm's install error
+	// +optional
+	packageManagerVersion string,
+	// Activate yarn and pnpm with Corepack, using the version declared by the packageManager field
+	// of package.json. Images without Corepack fall back to installing the latest release with npm
+	// +default=true
+	useCorepack bool,
+	// Image to use instead of node:<nodeVersion>-alpine, e.g. a mirror in a private registry or a
+	// debian-based variant
+	// +optional
+	baseImage string,
+	// A project .npmrc (e.g. scoped registries, legacy-peer-deps) to use instead of the source's.
+	// It is mounted as a secret so auth tokens in it aren't stored in any layer, and Publish's
+	// registry token is merged in from the user-level .npmrc
+	// +optional
+	npmrc *dagger.File,
+) (*NodeCi, error) {
+	if nodeVersion == "" || nodeVersion == autoNodeVersion {
+		var err error
+		nodeVersion, err = detectNodeVersion(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	declared := declaredPackageManager(ctx, source)
+	if packageManager == Auto {
+		packageManager = detectPackageManager(ctx, source, declared)
+	}
+
+	var npmrcSecret *dagger.Secret
+	if npmrc != nil {
+		var err error
+		npmrcSecret, err = npmrcAsSecret(ctx, npmrc)
+		if err != nil {
+			return nil, err
+		}
+
+		// The mounted secret takes the source's place, so the two can't conflict
+		source = source.WithoutFile(".npmrc")
+	}
+
 	return &NodeCi{
-		NodeVersion:    nodeVersion,
-		PackageManager: packageManager,
-		Source:         source,
-		Ctr:            nil,
+		BaseImage:              baseImage,
+		CaCert:                 caCert,
+		ContentCacheKey:        contentCacheKey,
+		NodeVersion:            nodeVersion,
+		Npmrc:                  npmrcSecret,
+		PackageManager:         packageManager,
+		PackageManagerVersion:  packageManagerVersion,
+		DeclaredPackageManager: declared,
+		UseCorepack:            useCorepack,
+		Source:                 source,
+		Ctr:                    nil,
+	}, nil
+}
+
+// npmrcAsSecret returns the .npmrc file's contents as a secret, named by its digest so distinct
+// files don't collide
+func npmrcAsSecret(ctx context.Context, npmrc *dagger.File) (*dagger.Secret, error) {
+	digest, err := npmrc.Digest(ctx, dagger.FileDigestOpts{ExcludeMetadata: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash .npmrc: %w", err)
+	}
+
+	contents, err := npmrc.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .npmrc: %w", err)
+	}
+
+	return dag.SetSecret("npmrc-"+shortDigest(digest), contents), nil
+}
+
+// detectPackageManager returns the package manager named by the declared packageManager field, or
+// the one whose lockfile is in the source, defaulting to npm
+func detectPackageManager(ctx context.Context, source *dagger.Directory, declared string) PackageManager {
+	return packageManagerFor(declared, func(name string) bool {
+		exists, err := source.Exists(ctx, name)
+		return err == nil && exists
+	})
+}
+
+// packageManagerFor returns the package manager named by the declared packageManager field, or the
+// one whose lockfile exists, defaulting to npm
+func packageManagerFor(declared string, exists func(name string) bool) PackageManager {
+	name, _, _ := strings.Cut(declared, "@")
+	switch manager := PackageManager(name); manager {
+	case NPM, Yarn, PNPM, Bun:
+		return manager
+	}
+
+	lockfiles := []struct {
+		name    string
+		manager PackageManager
+	}{
+		{"pnpm-lock.yaml", PNPM},
+		{"yarn.lock", Yarn},
+		{"bun.lockb", Bun},
+		{"package-lock.json", NPM},
+	}
+
+	for _, lockfile := range lockfiles {
+		if exists(lockfile.name) {
+			return lockfile.manager
+		}
+	}
+
+	return NPM
+}
+
+// declaredPackageManager returns the packageManager field of package.json (e.g. "pnpm@9.1.0"), or
+// an empty string if it isn't set
+func declaredPackageManager(ctx context.Context, source *dagger.Directory) string {
+	contents, err := source.File("package.json").Contents(ctx)
+	if err != nil {
+		return ""
+	}
+
+	var manifest struct {
+		PackageManager string `json:"packageManager"`
+	}
+
+	if json.Unmarshal([]byte(contents), &manifest) != nil {
+		return ""
+	}
+
+	return manifest.PackageManager
+}
+
+// detectNodeVersion returns the Node image version declared by .nvmrc or package.json engines.node,
+// or the default version when neither is present
+func detectNodeVersion(ctx context.Context, source *dagger.Directory) (string, error) {
+	if nvmrc, err := source.File(".nvmrc").Contents(ctx); err == nil && strings.TrimSpace(nvmrc) != "" {
+		version, err := parseNodeVersion(nvmrc)
+		if err != nil {
+			return "", fmt.Errorf("invalid Node version in .nvmrc: %w", err)
+		}
+
+		return version, nil
+	}
+
+	contents, err := source.File("package.json").Contents(ctx)
+	if err != nil {
+		return defaultNodeVersion, nil
+	}
+
+	var manifest struct {
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}
+
+	if err := json.Unmarshal([]byte(contents), &manifest); err != nil {
+		return "", fmt.Errorf("package.json is not valid JSON: %w", err)
+	}
+
+	if manifest.Engines.Node == "" {
+		return defaultNodeVersion, nil
+	}
+
+	version, err := parseNodeVersion(manifest.Engines.Node)
+	if err != nil {
+		return "", fmt.Errorf("invalid Node version in package.json engines: %w", err)
+	}
+
+	return version, nil
+}
+
+// parseNodeVersion reduces a version or range such as "v20.11.0", ">=18" or "lts/iron" to a
+// node image tag version. For ranges with alternatives the first is used
+func parseNodeVersion(spec string) (string, error) {
+	version := strings.TrimSpace(strings.Split(spec, "||")[0])
+
+	// nvm aliases, e.g. node, lts/* or lts/iron, map to the current, lts and codename image tags
+	if version == "node" {
+		return "current", nil
+	}
+
+	if alias, ok := strings.CutPrefix(version, "lts/"); ok {
+		if alias == "*" {
+			return "lts", nil
+		}
+
+		version = alias
+	}
+
+	version = strings.TrimLeft(version, "<>=^~ ")
+	version = strings.TrimPrefix(version, "v")
+	version, _, _ = strings.Cut(version, ".")
+	if fields := strings.Fields(version); len(fields) > 0 {
+		version = fields[0]
+	}
+
+	if !nodeVersionPattern.MatchString(version) {
+		return "", fmt.Errorf("can't determine a Node image version from %q", spec)
 	}
+
+	return version, nil
 }
 
 // Base returns the base Node container
 func (m *NodeCi) Base() *dagger.Container {
 	container := dag.Container().
-		From("node:" + m.NodeVersion + "-alpine").
-		WithExec([]string{"apk", "add", "--no-cache", "git"})
+		From(m.baseImage())
+
+	if m.CaCert != nil {
+		// Node bundles its own CA store, so the certificate is also passed via NODE_EXTRA_CA_CERTS
+		container = container.
+			WithFile(caCertPath, m.CaCert).
+			WithExec([]string{"sh", "-c", trustCACommand(caCertPath, systemCABundle)}).
+			WithEnvVariable("NODE_EXTRA_CA_CERTS", caCertPath)
+	}
+
+	container = container.WithExec([]string{"sh", "-c", systemPackagesScript([]string{"git"}, []string{"git"})})
 
 	switch m.PackageManager {
-	case PNPM:
-		container = container.WithExec([]string{"npm", "install", "-g", "pnpm"})
-	case Yarn:
-		container = container.WithExec([]string{"npm", "install", "-g", "yarn"})
+	case PNPM, Yarn:
+		if m.useCorepack() {
+			container = container.
+				WithEnvVariable("COREPACK_ENABLE_DOWNLOAD_PROMPT", "0").
+				WithExec([]string{"sh", "-c", corepackScript(m.PackageManager)})
+
+			// A project declaring a different manager would otherwise be refused by Corepack
+			if name, _, _ := strings.Cut(m.DeclaredPackageManager, "@"); name != "" && name != string(m.PackageManager) {
+				container = container.WithEnvVariable("COREPACK_ENABLE_STRICT", "0")
+			}
+		} else {
+			container = container.WithExec([]string{"npm", "install", "-g", m.packageSpec(string(m.PackageManager))})
+		}
+	case Bun:
+		installer := "curl -fsSL https://bun.sh/install | bash"
+		if m.PackageManagerVersion != "" {
+			installer += " -s bun-v" + m.PackageManagerVersion
+		}
+
+		// The install script detects alpine and fetches the musl build, which links against libstdc++
+		container = container.
+			WithExec([]string{"sh", "-c", systemPackagesScript(
+				[]string{"bash", "curl", "unzip", "libstdc++", "libgcc"},
+				[]string{"curl", "unzip", "ca-certificates"},
+			)}).
+			WithExec([]string{"sh", "-c", installer}).
+			WithEnvVariable("PATH", "/root/.bun/bin:${PATH}", dagger.ContainerWithEnvVariableOpts{Expand: true})
+	default:
+		if m.PackageManagerVersion != "" {
+			container = container.WithExec([]string{"npm", "install", "-g", m.packageSpec("npm")})
+		}
 	}
 
 	return container
 }
 
-// getPackageManagerCache returns the appropriate cache path and volume name
-func (m *NodeCi) getPackageManagerCache() (string, string) {
+// trustCACommand returns the shell command adding the certificate to the system trust store,
+// appending it to the bundle directly on images without update-ca-certificates
+func trustCACommand(cert string, bundle string) string {
+	return "update-ca-certificates 2>/dev/null || cat " + cert + " >> " + bundle
+}
+
+// useCorepack reports whether the package manager should be activated with Corepack, which is the
+// case when enabled and no version was pinned explicitly
+func (m *NodeCi) useCorepack() bool {
+	return m.UseCorepack && m.PackageManagerVersion == ""
+}
+
+// corepackScript enables the package manager with Corepack, falling back to a global npm install on
+// images that don't bundle Corepack. The bundled Corepack is updated first as older releases can't
+// verify current package signatures
+func corepackScript(manager PackageManager) string {
+	return fmt.Sprintf(`if command -v corepack >/dev/null 2>&1; then
+  npm install -g corepack@latest && corepack enable %[1]s
+else
+  npm install -g %[1]s
+fi`, manager)
+}
+
+// packageSpec returns the npm package spec for a tool, pinned to the package manager version if set
+func (m *NodeCi) packageSpec(name string) string {
+	if m.PackageManagerVersion == "" {
+		return name
+	}
+
+	return name + "@" + m.PackageManagerVersion
+}
+
+// WithOverlay merges a directory over the source, with overlay files taking precedence, e.g. to test
+// a patch without committing it. The overlay also applies to an already installed container
+func (m *NodeCi) WithOverlay(
+	// Files to overlay onto the source directory
+	overlay *dagger.Directory,
+) *NodeCi {
+	m.Source = m.Source.WithDirectory(".", overlay)
+	if m.Ctr != nil {
+		m.Ctr = m.Ctr.WithDirectory("/app", overlay)
+	}
+
+	return m
+}
+
+// WithWorkspace runs commands in a package of a monorepo workspace. Dependencies are still installed
+// from the workspace root and its lockfile, so the package only needs its own package.json
+func (m *NodeCi) WithWorkspace(
+	ctx context.Context,
+	// Path of the package relative to the workspace root (e.g. packages/web)
+	path string,
+) (*NodeCi, error) {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+		return nil, fmt.Errorf("workspace path must be relative to the source directory: %s", path)
+	}
+
+	exists, err := m.Source.Exists(ctx, filepath.Join(path, "package.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check workspace %s: %w", path, err)
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("workspace %s has no package.json", path)
+	}
+
+	m.Workspace = path
+	if m.Ctr != nil {
+		m.Ctr = m.Ctr.WithWorkdir(m.workdir())
+	}
+
+	return m, nil
+}
+
+// workdir returns the directory commands run in, the workspace package when one is set
+func (m *NodeCi) workdir() string {
+	return filepath.Join("/app", m.Workspace)
+}
+
+// ModuleInfo describes the configuration a module will run with
+type ModuleInfo struct {
+	// Name of the module
+	Module string
+	// Node version used by the base image
+	NodeVersion string
+	// Package manager used to install and run scripts
+	PackageManager PackageManager
+	// Base image reference
+	BaseImage string
+}
+
+// Info returns the module name, tool versions and base image this instance will use
+func (m *NodeCi) Info(ctx context.Context) *ModuleInfo {
+	return &ModuleInfo{
+		Module:         "node-ci",
+		NodeVersion:    m.NodeVersion,
+		PackageManager: m.PackageManager,
+		BaseImage:      m.baseImage(),
+	}
+}
+
+// baseImage returns the Node image reference
+func (m *NodeCi) baseImage() string {
+	if m.BaseImage != "" {
+		return m.BaseImage
+	}
+
+	return "node:" + m.NodeVersion + "-alpine"
+}
+
+// systemPackagesScript installs OS packages with apk on alpine-based images and apt otherwise
+func systemPackagesScript(apkPackages []string, aptPackages []string) string {
+	return fmt.Sprintf(`if command -v apk >/dev/null 2>&1; then
+  apk add --no-cache %s
+else
+  apt-get update && apt-get install -y --no-install-recommends %s && rm -rf /var/lib/apt/lists/*
+fi`, strings.Join(apkPackages, " "), strings.Join(aptPackages, " "))
+}
+
+// getPackageManagerCache returns the appropriate cache path and volume name, suffixed with the
+// lockfile hash when content cache keys are enabled
+func (m *NodeCi) getPackageManagerCache(ctx context.Context) (string, string) {
+	path, volume := m.packageManagerCache()
+	if !m.ContentCacheKey {
+		return path, volume
+	}
+
+	digest, err := m.Source.File(m.getLockfile()).Digest(ctx, dagger.FileDigestOpts{ExcludeMetadata: true})
+	if err != nil {
+		// Without a lockfile there is nothing to key on, so fall back to the shared cache
+		return path, volume
+	}
+
+	return path, contentCacheVolume(volume, digest)
+}
+
+// contentCacheVolume returns the cache volume name keyed by the lockfile digest
+func contentCacheVolume(volume string, digest string) string {
+	return volume + "-" + shortDigest(digest)
+}
+
+// packageManagerCache returns the cache path and shared volume name for the package manager
+func (m *NodeCi) packageManagerCache() (string, string) {
 	switch m.PackageManager {
 	case NPM:
 		return "/root/.npm", "npm-cache"
@@ -73,11 +509,38 @@ func (m *NodeCi) getPackageManagerCache() (string, string) {
 		return "/usr/local/share/.cache/yarn", "yarn-cache"
 	case PNPM:
 		return "/root/.local/share/pnpm/store", "pnpm-cache"
+	case Bun:
+		return "/root/.bun/install/cache", "bun-cache"
 	default:
 		return "/root/.npm", "npm-cache"
 	}
 }
 
+// buildCacheVolume returns the cache volume name for a build cache path, keeping the original
+// volume name for the Next.js cache
+func buildCacheVolume(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == nextCachePath {
+		return "nextjs-cache"
+	}
+
+	return "node-build-cache-" + strings.NewReplacer("/", "-", ".", "").Replace(path)
+}
+
+// shortDigest returns an abbreviated hex digest suitable for use in a cache volume name
+func shortDigest(digest string) string {
+	_, hex, ok := strings.Cut(digest, ":")
+	if !ok {
+		hex = digest
+	}
+
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+
+	return hex
+}
+
 // getLockfile returns the lockfile name for the package manager
 func (m *NodeCi) getLockfile() string {
 	switch m.PackageManager {
@@ -87,13 +550,34 @@ func (m *NodeCi) getLockfile() string {
 		return "yarn.lock"
 	case PNPM:
 		return "pnpm-lock.yaml"
+	case Bun:
+		return "bun.lockb"
 	default:
 		return "package-lock.json"
 	}
 }
 
-// getInstallCommand returns the install command for the package manager
-func (m *NodeCi) getInstallCommand() []string {
+// getInstallCommand returns the install command for the package manager, omitting
+// devDependencies when production is set. Yarn 2+ dropped install --production, so production
+// installs focus every workspace instead, which Yarn 2 and 3 need the workspace-tools plugin for
+func (m *NodeCi) getInstallCommand(production bool) []string {
+	if production {
+		switch m.PackageManager {
+		case Yarn:
+			if m.yarnMajor() >= 2 {
+				return []string{"yarn", "workspaces", "focus", "--all", "--production"}
+			}
+
+			return []string{"yarn", "install", "--frozen-lockfile", "--production"}
+		case PNPM:
+			return []string{"pnpm", "install", "--frozen-lockfile", "--prod"}
+		case Bun:
+			return []string{"bun", "install", "--frozen-lockfile", "--production"}
+		default:
+			return []string{"npm", "ci", "--omit=dev"}
+		}
+	}
+
 	switch m.PackageManager {
 	case NPM:
 		return []string{"npm", "ci"}
@@ -101,40 +585,219 @@ func (m *NodeCi) getInstallCommand() []string {
 		return []string{"yarn", "install", "--frozen-lockfile"}
 	case PNPM:
 		return []string{"pnpm", "install", "--frozen-lockfile"}
+	case Bun:
+		return []string{"bun", "install", "--frozen-lockfile"}
 	default:
 		return []string{"npm", "ci"}
 	}
 }
 
+// retryScript wraps a command in a shell loop that retries failures with exponential backoff,
+// giving up immediately on lockfile errors. The exit status is recorded through a file rather than
+// pipefail, which shells such as dash on Debian-based images don't support
+func retryScript(cmd []string, retries int, delay int) string {
+	return fmt.Sprintf(`attempt=0
+delay=%d
+until { %s 2>&1; echo $? > /tmp/install.status; } | tee /tmp/install.log; [ "$(cat /tmp/install.status)" -eq 0 ]; do
+  if grep -qE '%s' /tmp/install.log; then
+    echo "Install failed due to a lockfile error, not retrying" >&2
+    exit 1
+  fi
+  attempt=$((attempt + 1))
+  if [ "$attempt" -gt %d ]; then
+    echo "Install failed after $attempt attempts" >&2
+    exit 1
+  fi
+  echo "Install failed, retrying in ${delay}s (attempt $attempt of %d)" >&2
+  sleep "$delay"
+  delay=$((delay * 2))
+done
+rm -f /tmp/install.log /tmp/install.status`, delay, strings.Join(cmd, " "), lockfileErrorPattern, retries, retries)
+}
+
 // getContainer returns the container, installing dependencies if needed
 func (m *NodeCi) getContainer(ctx context.Context) *dagger.Container {
 	if m.Ctr != nil {
 		return m.Ctr
 	}
-	return m.Install(ctx).Ctr
+	return m.Install(ctx, false, "", defaultInstallRetries, defaultInstallRetryDelay, false).Ctr
+}
+
+// installOpts configures how dependencies are installed
+type installOpts struct {
+	production bool
+	noCache    bool
+	cacheBust  string
+	retries    int
+	retryDelay int
+	// unlocked resolves dependencies from package.json when the package manager's lockfile is missing
+	unlocked bool
 }
 
 // Install installs dependencies with caching and returns the NodeCi instance for chaining
-func (m *NodeCi) Install(ctx context.Context) *NodeCi {
-	cachePath, volumeName := m.getPackageManagerCache()
+func (m *NodeCi) Install(
+	ctx context.Context,
+	// Skip the package manager cache volume, forcing a fresh fetch of all dependencies
+	// +optional
+	noCache bool,
+	// Arbitrary value that invalidates the install layer whenever it changes
+	// +optional
+	cacheBust string,
+	// Number of times to retry a failed install. Lockfile errors are never retried
+	// +default=2
+	installRetries int,
+	// Seconds to wait before the first retry, doubling after each attempt
+	// +default=5
+	installRetryDelay int,
+	// Install without devDependencies, e.g. for a container to ship. Scripts that need dev tooling
+	// such as build or test will fail
+	// +optional
+	installProd bool,
+) *NodeCi {
+	m.Ctr = m.installContainer(ctx, installOpts{
+		production: installProd,
+		noCache:    noCache,
+		cacheBust:  cacheBust,
+		retries:    installRetries,
+		retryDelay: installRetryDelay,
+	})
+
+	return m
+}
+
+// NodeModules returns the installed node_modules directory, e.g. to copy into a runtime image.
+// With pnpm the directory includes the .pnpm virtual store its relative symlinks point into,
+// so it must be copied as a whole
+func (m *NodeCi) NodeModules(
+	ctx context.Context,
+	// Install without devDependencies
+	// +optional
+	production bool,
+) *dagger.Directory {
+	if !production {
+		return m.getContainer(ctx).Directory("/app/node_modules")
+	}
+
+	return m.installContainer(ctx, productionInstallOpts()).Directory("/app/node_modules")
+}
+
+// productionInstallOpts returns the options NodeModules installs production dependencies with
+func productionInstallOpts() installOpts {
+	return installOpts{
+		production: true,
+		retries:    defaultInstallRetries,
+		retryDelay: defaultInstallRetryDelay,
+	}
+}
+
+// installContainer returns a container with the package manifest and lockfile copied in,
+// dependencies installed and the source mounted
+func (m *NodeCi) installContainer(ctx context.Context, opts installOpts) *dagger.Container {
+	hasLockfile, err := m.Source.Exists(ctx, m.getLockfile())
+	hasLockfile = err == nil && hasLockfile
+
+	cache := func() (string, string) {
+		return m.getPackageManagerCache(ctx)
+	}
+
+	container := m.Base()
+	for _, step := range m.installSteps(opts, hasLockfile, cache) {
+		switch step.kind {
+		case workdirStep:
+			container = container.WithWorkdir(step.path)
+		case mountCacheStep:
+			container = container.WithMountedCache(step.path, dag.CacheVolume(step.value))
+		case envStep:
+			container = container.WithEnvVariable(step.path, step.value)
+		case mountNpmrcStep:
+			container = container.WithMountedSecret(step.path, m.Npmrc)
+		case copyFileStep:
+			container = container.WithFile(step.path, m.Source.File(step.value))
+		case copySourceStep:
+			container = container.WithDirectory(step.path, m.Source)
+		case execStep:
+			container = container.WithExec(step.args)
+		}
+	}
+
+	return container
+}
+
+// installStepKind is the kind of change installContainer makes to the base container
+type installStepKind int
+
+const (
+	workdirStep installStepKind = iota
+	mountCacheStep
+	envStep
+	mountNpmrcStep
+	copyFileStep
+	copySourceStep
+	execStep
+)
+
+// installStep is one change installContainer makes to the base container. The path is the container
+// path, or the variable name for an env step, and the value the cache volume, variable value or
+// source file to copy
+type installStep struct {
+	kind  installStepKind
+	path  string
+	value string
+	args  []string
+}
+
+// installSteps returns the changes installContainer makes to the base container, in order. The cache
+// volume is only resolved when the install uses the cache
+func (m *NodeCi) installSteps(opts installOpts, hasLockfile bool, cache func() (string, string)) []installStep {
 	lockfile := m.getLockfile()
+	steps := []installStep{{kind: workdirStep, path: "/app"}}
+
+	if !opts.noCache {
+		cachePath, volumeName := cache()
+		steps = append(steps, installStep{kind: mountCacheStep, path: cachePath, value: volumeName})
+	}
 
-	container := m.Base().
-		WithWorkdir("/app").
-		WithMountedCache(cachePath, dag.CacheVolume(volumeName)).
-		WithFile("/app/package.json", m.Source.File("package.json"))
+	if opts.cacheBust != "" {
+		steps = append(steps, installStep{kind: envStep, path: "CACHE_BUSTER", value: opts.cacheBust})
+	}
 
-	lockfileEntry, err := m.Source.File(lockfile).ID(ctx)
-	if err == nil && lockfileEntry != "" {
-		container = container.WithFile("/app/"+lockfile, m.Source.File(lockfile))
+	if m.Npmrc != nil {
+		steps = append(steps, installStep{kind: mountNpmrcStep, path: "/app/.npmrc"})
 	}
 
-	m.Ctr = container.WithExec(m.getInstallCommand()).WithDirectory("/app", m.Source)
+	installCmd := m.getInstallCommand(opts.production)
+	if opts.unlocked && !hasLockfile {
+		installCmd = []string{string(m.PackageManager), "install"}
+	}
 
-	return m
+	if opts.retries > 0 {
+		installCmd = []string{"sh", "-c", retryScript(installCmd, opts.retries, opts.retryDelay)}
+	}
+
+	// Workspace installs need every package's manifest to resolve the dependency graph, so the
+	// whole source is copied in before installing
+	if m.Workspace != "" {
+		return append(steps,
+			installStep{kind: copySourceStep, path: "/app"},
+			installStep{kind: execStep, args: installCmd},
+			installStep{kind: workdirStep, path: m.workdir()},
+		)
+	}
+
+	steps = append(steps, installStep{kind: copyFileStep, path: "/app/package.json", value: "package.json"})
+
+	if hasLockfile {
+		steps = append(steps, installStep{kind: copyFileStep, path: "/app/" + lockfile, value: lockfile})
+	}
+
+	return append(steps,
+		installStep{kind: execStep, args: installCmd},
+		installStep{kind: copySourceStep, path: "/app"},
+	)
 }
 
-// WithExec runs a command and returns the NodeCi instance for chaining. Prepends package manager run
+// WithExec runs a command and returns the NodeCi instance for chaining. Prepends package manager run.
+// Output is streamed live to the Dagger progress view as the command runs, use --progress=plain to follow it in CI logs
 func (m *NodeCi) WithExec(
 	ctx context.Context,
 	// Command to run (e.g., "lint", "test", "prettier")
@@ -143,16 +806,17 @@ func (m *NodeCi) WithExec(
 	// +optional
 	args []string,
 ) *NodeCi {
-	cmdParts := []string{string(m.PackageManager), "run", cmd}
-	if len(args) > 0 {
-		cmdParts = append(cmdParts, args...)
-	}
-
-	m.Ctr = m.getContainer(ctx).WithExec(cmdParts)
+	m.Ctr = m.getContainer(ctx).WithExec(m.runArgs(cmd, args))
 	return m
 }
 
-// Exec runs a command and returns the output immediately. Prepends package manager run
+// runArgs returns the command running a package.json script with the package manager
+func (m *NodeCi) runArgs(cmd string, args []string) []string {
+	return append([]string{string(m.PackageManager), "run", cmd}, args...)
+}
+
+// Exec runs a command and returns the output immediately. Prepends package manager run.
+// Output is streamed live to the Dagger progress view while the full stdout is still returned
 func (m *NodeCi) Exec(
 	ctx context.Context,
 	// Command to run (e.g., "lint", "test", "prettier")
@@ -164,6 +828,31 @@ func (m *NodeCi) Exec(
 	return m.WithExec(ctx, cmd, args).Stdout(ctx)
 }
 
+// WithServiceBinding attaches a service reachable at the alias hostname for subsequent commands, e.g.
+// a database for integration tests
+func (m *NodeCi) WithServiceBinding(
+	ctx context.Context,
+	// Hostname the service is reachable at (e.g. db)
+	alias string,
+	// The service to bind, such as the mysql module's service
+	svc *dagger.Service,
+) *NodeCi {
+	m.Ctr = m.getContainer(ctx).WithServiceBinding(alias, svc)
+	return m
+}
+
+// WithEnvVariable sets an environment variable for subsequent commands
+func (m *NodeCi) WithEnvVariable(
+	ctx context.Context,
+	// Variable name
+	name string,
+	// Variable value
+	value string,
+) *NodeCi {
+	m.Ctr = m.getContainer(ctx).WithEnvVariable(name, value)
+	return m
+}
+
 // Lint runs the lint command and returns output
 func (m *NodeCi) Lint(ctx context.Context) (string, error) {
 	return m.Exec(ctx, "lint", nil)
@@ -179,6 +868,31 @@ func (m *NodeCi) Test(ctx context.Context) (string, error) {
 	return m.Exec(ctx, "test", nil)
 }
 
+// TestCoverage runs the test script with coverage enabled and returns the coverage report directory,
+// e.g. to export lcov.info
+func (m *NodeCi) TestCoverage(
+	ctx context.Context,
+	// Directory the test runner writes the coverage report to, relative to the project root
+	// +default="coverage"
+	outputPath string,
+	// Arguments passed to the test script, defaults to --coverage as used by Jest and Vitest
+	// +optional
+	args []string,
+) *dagger.Directory {
+	if len(args) == 0 {
+		args = []string{"--coverage"}
+	}
+
+	// npm treats flags before -- as its own config rather than passing them to the script
+	if m.PackageManager == NPM {
+		args = append([]string{"--"}, args...)
+	}
+
+	return m.getContainer(ctx).
+		WithExec(m.runArgs("test", args)).
+		Directory(outputPath)
+}
+
 // WithTest runs the test command for chaining
 func (m *NodeCi) WithTest(ctx context.Context) *NodeCi {
 	return m.WithExec(ctx, "test", nil)
@@ -187,15 +901,27 @@ func (m *NodeCi) WithTest(ctx context.Context) *NodeCi {
 // WithBuild builds the application with optional Next.js cache
 func (m *NodeCi) WithBuild(
 	ctx context.Context,
-	// Use Next.js build cache
+	// Use Next.js build cache, equivalent to adding .next/cache to buildCachePaths
 	// +optional
 	useNextCache bool,
 	// Additional environment variables for the build in KEY=VALUE format
 	// +optional
 	buildEnv []string,
+	// Directories to mount as build caches, relative to the project root (e.g. node_modules/.vite)
+	// +optional
+	buildCachePaths []string,
 ) *NodeCi {
-	container := m.getContainer(ctx)
+	m.Ctr = m.buildContainer(m.getContainer(ctx), useNextCache, buildEnv, buildCachePaths)
+	return m
+}
 
+// buildContainer runs the build script in the container with the given environment and cache mounts
+func (m *NodeCi) buildContainer(
+	container *dagger.Container,
+	useNextCache bool,
+	buildEnv []string,
+	buildCachePaths []string,
+) *dagger.Container {
 	for _, env := range buildEnv {
 		parts := strings.SplitN(env, "=", 2)
 		if len(parts) == 2 {
@@ -203,41 +929,283 @@ func (m *NodeCi) WithBuild(
 		}
 	}
 
-	if useNextCache {
-		container = container.WithMountedCache("/app/.next/cache", dag.CacheVolume("nextjs-cache"))
+	if useNextCache && !slices.Contains(buildCachePaths, nextCachePath) {
+		buildCachePaths = append(buildCachePaths, nextCachePath)
 	}
 
-	m.Ctr = container.WithExec([]string{string(m.PackageManager), "run", "build"})
-	return m
+	for _, path := range buildCachePaths {
+		container = container.WithMountedCache(filepath.Join(m.workdir(), path), dag.CacheVolume(buildCacheVolume(path)))
+	}
+
+	return container.WithExec(m.runArgs("build", nil))
 }
 
 // Build builds the application and returns the container
 func (m *NodeCi) Build(
 	ctx context.Context,
-	// Use Next.js build cache
+	// Use Next.js build cache, equivalent to adding .next/cache to buildCachePaths
 	// +optional
 	useNextCache bool,
 	// Additional environment variables for the build in KEY=VALUE format
 	// +optional
 	buildEnv []string,
+	// Directories to mount as build caches, relative to the project root (e.g. node_modules/.vite)
+	// +optional
+	buildCachePaths []string,
 ) *dagger.Container {
-	return m.WithBuild(ctx, useNextCache, buildEnv).Ctr
+	return m.WithBuild(ctx, useNextCache, buildEnv, buildCachePaths).Ctr
 }
 
 // BuildOutput returns the build output directory
 func (m *NodeCi) BuildOutput(
 	ctx context.Context,
-	// Use Next.js build cache
+	// Use Next.js build cache, equivalent to adding .next/cache to buildCachePaths
 	// +optional
 	useNextCache bool,
 	// Additional environment variables for the build in KEY=VALUE format
 	// +optional
 	buildEnv []string,
+	// Directories to mount as build caches, relative to the project root (e.g. node_modules/.vite)
+	// +optional
+	buildCachePaths []string,
 	// Output directory path
 	// +default=".next"
 	outputPath string,
 ) *dagger.Directory {
-	return m.WithBuild(ctx, useNextCache, buildEnv).Directory(outputPath)
+	return m.WithBuild(ctx, useNextCache, buildEnv, buildCachePaths).Directory(outputPath)
+}
+
+// Audit scans the installed dependencies for known vulnerabilities, failing when any are found at
+// or above the severity threshold. Yarn 2+ projects are audited with yarn npm audit, as Berry
+// dropped the classic audit command
+func (m *NodeCi) Audit(
+	ctx context.Context,
+	// Minimum severity that fails the audit: low, moderate, high or critical
+	// +default="high"
+	severity string,
+) (string, error) {
+	switch severity {
+	case "low", "moderate", "high", "critical":
+	default:
+		return "", fmt.Errorf("invalid audit severity: %s", severity)
+	}
+
+	return m.getContainer(ctx).
+		WithExec(m.auditArgs(severity)).
+		Stdout(ctx)
+}
+
+// auditArgs returns the package manager's audit command for the severity threshold
+func (m *NodeCi) auditArgs(severity string) []string {
+	switch m.PackageManager {
+	case Yarn:
+		if m.yarnMajor() >= 2 {
+			return []string{"yarn", "npm", "audit", "--recursive", "--severity", severity}
+		}
+
+		return []string{"yarn", "audit", "--level", severity}
+	case PNPM:
+		return []string{"pnpm", "audit", "--audit-level", severity}
+	case Bun:
+		return []string{"bun", "audit", "--audit-level=" + severity}
+	default:
+		return []string{"npm", "audit", "--audit-level=" + severity}
+	}
+}
+
+// yarnMajor returns the major version of the Yarn in use: the pinned version, otherwise the one
+// Corepack activates from package.json. Without either, the module's own install is classic v1
+func (m *NodeCi) yarnMajor() int {
+	version := m.PackageManagerVersion
+	if version == "" && m.useCorepack() {
+		if name, declared, _ := strings.Cut(m.DeclaredPackageManager, "@"); name == string(Yarn) {
+			version = declared
+		}
+	}
+
+	major, err := strconv.Atoi(strings.TrimPrefix(strings.SplitN(version, ".", 2)[0], "v"))
+	if err != nil {
+		return 1
+	}
+
+	return major
+}
+
+// FormatCheck runs prettier --check over the source, using the project's prettier when installed and
+// npx otherwise. Returns the output listing unformatted files, with an error if any would change
+func (m *NodeCi) FormatCheck(ctx context.Context) (string, error) {
+	ctr := m.getContainer(ctx).
+		WithExec([]string{"sh", "-c", prettierCommand + " --check ."}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run prettier: %w", err)
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read prettier output: %w", err)
+	}
+
+	if exitCode != 0 {
+		return out, fmt.Errorf("files are not formatted:\n%s", out)
+	}
+
+	return out, nil
+}
+
+// TypeCheck runs tsc --noEmit, using the project's typescript when installed and npx otherwise.
+// Returns the compiler diagnostics, with an error if there are type errors
+func (m *NodeCi) TypeCheck(ctx context.Context) (string, error) {
+	exists, err := m.Source.Exists(ctx, filepath.Join(m.Workspace, "tsconfig.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to check for tsconfig.json: %w", err)
+	}
+
+	if !exists {
+		return "", fmt.Errorf("no tsconfig.json found in %s, type checking requires a TypeScript project", m.workdir())
+	}
+
+	ctr := m.getContainer(ctx).
+		WithExec([]string{"sh", "-c", tscCommand + " --noEmit"}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run tsc: %w", err)
+	}
+
+	out, err := ctr.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read tsc output: %w", err)
+	}
+
+	if exitCode != 0 {
+		return out, fmt.Errorf("type check failed:\n%s", out)
+	}
+
+	return out, nil
+}
+
+// FormatWrite formats the source with prettier and returns the formatted /app directory, without
+// node_modules so it can be exported over the source
+func (m *NodeCi) FormatWrite(ctx context.Context) *dagger.Directory {
+	return m.getContainer(ctx).
+		WithExec([]string{"sh", "-c", prettierCommand + " --write ."}).
+		Directory("/app").
+		WithoutDirectory("node_modules")
+}
+
+// MatrixResult is the outcome of running the tests under one package manager
+type MatrixResult struct {
+	// Package manager the tests ran under
+	PackageManager PackageManager
+	// Output of the test script
+	Output string
+}
+
+// Matrix installs dependencies and runs the test script under each package manager in parallel, e.g.
+// to check a library works for all of its consumers. Managers without a lockfile in the source
+// resolve dependencies from package.json. The error names the package manager that failed
+func (m *NodeCi) Matrix(
+	ctx context.Context,
+	// Package managers to test with
+	// +default=["npm", "yarn", "pnpm"]
+	managers []PackageManager,
+) ([]*MatrixResult, error) {
+	if len(managers) == 0 {
+		return nil, fmt.Errorf("no package managers to test with")
+	}
+
+	// Managers are validated up front so no install is started for a matrix that would be rejected
+	for _, manager := range managers {
+		switch manager {
+		case NPM, Yarn, PNPM, Bun:
+		default:
+			return nil, fmt.Errorf("invalid package manager: %s", manager)
+		}
+	}
+
+	return runMatrix(ctx, managers, func(ctx context.Context, manager PackageManager) (string, error) {
+		// Each manager gets its own instance, and so its own base image and cache volume
+		instance := *m
+		instance.PackageManager = manager
+		instance.PackageManagerVersion = ""
+
+		return instance.installContainer(ctx, installOpts{
+			retries:    defaultInstallRetries,
+			retryDelay: defaultInstallRetryDelay,
+			unlocked:   true,
+		}).
+			WithExec(instance.runArgs("test", nil)).
+			Stdout(ctx)
+	})
+}
+
+// runMatrix runs the tests for each package manager in parallel, returning the results in the order
+// of the managers or an error naming the manager that failed
+func runMatrix(ctx context.Context, managers []PackageManager, run func(context.Context, PackageManager) (string, error)) ([]*MatrixResult, error) {
+	results := make([]*MatrixResult, len(managers))
+	g, ctx := errgroup.WithContext(ctx)
+
+	for i, manager := range managers {
+		g.Go(func() error {
+			out, err := run(ctx, manager)
+			if err != nil {
+				return fmt.Errorf("%s: %w", manager, err)
+			}
+
+			results[i] = &MatrixResult{PackageManager: manager, Output: out}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// All runs lint, test, and build in parallel against the installed dependencies, returning an
+// error naming the first step that failed
+func (m *NodeCi) All(
+	ctx context.Context,
+	// Use Next.js build cache, equivalent to adding .next/cache to buildCachePaths
+	// +optional
+	useNextCache bool,
+	// Additional environment variables for the build in KEY=VALUE format
+	// +optional
+	buildEnv []string,
+	// Directories to mount as build caches, relative to the project root (e.g. node_modules/.vite)
+	// +optional
+	buildCachePaths []string,
+) error {
+	// Each step derives from the same installed container, so dependencies are installed once
+	installed := m.getContainer(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		if _, err := installed.WithExec(m.runArgs("lint", nil)).Sync(ctx); err != nil {
+			return fmt.Errorf("lint failed: %w", err)
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		if _, err := installed.WithExec(m.runArgs("test", nil)).Sync(ctx); err != nil {
+			return fmt.Errorf("test failed: %w", err)
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		if _, err := m.buildContainer(installed, useNextCache, buildEnv, buildCachePaths).Sync(ctx); err != nil {
+			return fmt.Errorf("build failed: %w", err)
+		}
+		return nil
+	})
+
+	return g.Wait()
 }
 
 // Directory returns a directory from the container
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"dagger/node-ci/internal/dagger"
+)
+
+func TestRetryScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	tests := []struct {
+		name         string
+		failures     int
+		output       string
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"succeeds first time", 0, "installed", false, 1},
+		{"retries a failure", 1, "network error", false, 2},
+		{"gives up after the retries", 5, "network error", true, 3},
+		{"doesn't retry lockfile errors", 5, "ERR_PNPM_OUTDATED_LOCKFILE", true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			counter := filepath.Join(dir, "attempts")
+
+			// The stub install fails the given number of times before succeeding
+			stub := filepath.Join(dir, "install.sh")
+			script := fmt.Sprintf(`n=$(cat %[1]s 2>/dev/null || echo 0)
+echo $((n + 1)) > %[1]s
+echo %[2]s
+[ "$n" -ge %[3]d ]
+`, counter, tt.output, tt.failures)
+
+			if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := exec.Command("sh", "-c", retryScript([]string{"sh", stub}, 2, 0)).CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retry script error = %v, want error %t\n%s", err, tt.wantErr, out)
+			}
+
+			attempts, err := os.ReadFile(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(string(attempts)); got != fmt.Sprint(tt.wantAttempts) {
+				t.Errorf("install ran %s times, want %d\n%s", got, tt.wantAttempts, out)
+			}
+		})
+	}
+}
+
+func TestBuildCacheVolume(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{".next/cache", "nextjs-cache"},
+		{"/.next/cache/", "nextjs-cache"},
+		{"node_modules/.vite", "node-build-cache-node_modules-vite"},
+		{".turbo", "node-build-cache-turbo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := buildCacheVolume(tt.path); got != tt.want {
+				t.Errorf("buildCacheVolume() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNodeVersion(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"20", "20", false},
+		{"v20.11.0", "20", false},
+		{">=18", "18", false},
+		{"^18.17.0 || >=20", "18", false},
+		{"lts/iron", "iron", false},
+		{"lts/*", "lts", false},
+		{"node", "current", false},
+		{">=18 <21", "18", false},
+		{"latest-ish", "", true},
+		{"|| 18", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseNodeVersion(tt.spec)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseNodeVersion() = %q, %v, want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditArgs(t *testing.T) {
+	tests := []struct {
+		manager PackageManager
+		want    []string
+	}{
+		{NPM, []string{"npm", "audit", "--audit-level=high"}},
+		{Yarn, []string{"yarn", "audit", "--level", "high"}},
+		{PNPM, []string{"pnpm", "audit", "--audit-level", "high"}},
+		{Bun, []string{"bun", "audit", "--audit-level=high"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.manager), func(t *testing.T) {
+			m := &NodeCi{PackageManager: tt.manager}
+			if got := m.auditArgs("high"); !slices.Equal(got, tt.want) {
+				t.Errorf("auditArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatrixInvalidManagers(t *testing.T) {
+	tests := []struct {
+		name     string
+		managers []PackageManager
+		wantErr  string
+	}{
+		{"no managers", nil, "no package managers"},
+		{"unknown manager", []PackageManager{NPM, "bogus"}, "invalid package manager: bogus"},
+		{"auto is not a manager", []PackageManager{Auto}, "invalid package manager: auto"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Validation fails before any install starts, so no engine is needed
+			_, err := (&NodeCi{}).Matrix(context.Background(), tt.managers)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Matrix() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunMatrix(t *testing.T) {
+	errTestsFailed := errors.New("exit code: 1")
+
+	run := func(ctx context.Context, manager PackageManager) (string, error) {
+		if manager == Yarn {
+			return "", errTestsFailed
+		}
+
+		return string(manager) + " passed", nil
+	}
+
+	results, err := runMatrix(context.Background(), []PackageManager{NPM, PNPM}, run)
+	if err != nil {
+		t.Fatalf("runMatrix() error = %v", err)
+	}
+
+	for i, manager := range []PackageManager{NPM, PNPM} {
+		if results[i].PackageManager != manager || results[i].Output != string(manager)+" passed" {
+			t.Errorf("runMatrix() result %d = %+v, want the %s run", i, results[i], manager)
+		}
+	}
+
+	_, err = runMatrix(context.Background(), []PackageManager{NPM, Yarn, PNPM}, run)
+	if !errors.Is(err, errTestsFailed) || !strings.HasPrefix(err.Error(), "yarn: ") {
+		t.Errorf("runMatrix() error = %v, want the yarn failure", err)
+	}
+}
+
+func TestAuditArgsYarnVersion(t *testing.T) {
+	classic := []string{"yarn", "audit", "--level", "high"}
+	berry := []string{"yarn", "npm", "audit", "--recursive", "--severity", "high"}
+
+	tests := []struct {
+		name                   string
+		useCorepack            bool
+		declaredPackageManager string
+		packageManagerVersion  string
+		want                   []string
+	}{
+		{"module installed classic", false, "", "", classic},
+		{"corepack with berry declared", true, "yarn@4.1.0", "", berry},
+		{"corepack with a hash suffix", true, "yarn@3.6.4+sha512.abc", "", berry},
+		{"corepack with classic declared", true, "yarn@1.22.22", "", classic},
+		{"corepack without a declaration", true, "", "", classic},
+		{"corepack with another manager declared", true, "pnpm@9.0.0", "", classic},
+		{"declared berry without corepack", false, "yarn@4.1.0", "", classic},
+		{"pinned berry", true, "yarn@1.22.22", "4.1.0", berry},
+		{"pinned classic", false, "", "1.22.19", classic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &NodeCi{
+				PackageManager:         Yarn,
+				UseCorepack:            tt.useCorepack,
+				DeclaredPackageManager: tt.declaredPackageManager,
+				PackageManagerVersion:  tt.packageManagerVersion,
+			}
+
+			if got := m.auditArgs("high"); !slices.Equal(got, tt.want) {
+				t.Errorf("auditArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetInstallCommandProduction(t *testing.T) {
+	tests := []struct {
+		name     string
+		manager  PackageManager
+		declared string
+		want     []string
+	}{
+		{"npm", NPM, "", []string{"npm", "ci", "--omit=dev"}},
+		{"yarn classic", Yarn, "yarn@1.22.22", []string{"yarn", "install", "--frozen-lockfile", "--production"}},
+		{"yarn berry", Yarn, "yarn@4.1.0", []string{"yarn", "workspaces", "focus", "--all", "--production"}},
+		{"pnpm", PNPM, "", []string{"pnpm", "install", "--frozen-lockfile", "--prod"}},
+		{"bun", Bun, "", []string{"bun", "install", "--frozen-lockfile", "--production"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &NodeCi{PackageManager: tt.manager, UseCorepack: true, DeclaredPackageManager: tt.declared}
+
+			got := m.getInstallCommand(true)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("getInstallCommand() = %q, want %q", got, tt.want)
+			}
+
+			// Every production install must leave devDependencies out
+			if slices.Equal(got, m.getInstallCommand(false)) {
+				t.Errorf("getInstallCommand() = %q, want it to differ from the full install", got)
+			}
+		})
+	}
+}
+
+func TestProductionInstallOmitsDevDependencies(t *testing.T) {
+	dir, npm := npmFixture(t)
+
+	npm((&NodeCi{PackageManager: NPM}).getInstallCommand(true)...)
+
+	if _, err := os.Stat(filepath.Join(dir, "node_modules", "prod-dep")); err != nil {
+		t.Errorf("production install is missing the dependency: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "node_modules", "dev-dep")); !os.IsNotExist(err) {
+		t.Errorf("production install included the devDependency, stat error = %v", err)
+	}
+}
+
+func TestNodeModules(t *testing.T) {
+	m := &NodeCi{PackageManager: NPM}
+
+	// NodeModules installs production dependencies with the same retries as Install
+	steps := m.installSteps(productionInstallOpts(), true, func() (string, string) { return "/root/.npm", "npm-cache" })
+
+	i := slices.IndexFunc(steps, isStep(execStep))
+	if i == -1 || !strings.Contains(strings.Join(steps[i].args, " "), "npm ci --omit=dev 2>&1") {
+		t.Fatalf("installSteps() = %+v, want a retried production install", steps)
+	}
+
+	dir, npm := npmFixture(t)
+
+	npm(m.getInstallCommand(false)...)
+
+	for _, dep := range []string{"prod-dep", "dev-dep"} {
+		if _, err := os.Stat(filepath.Join(dir, "node_modules", dep, "package.json")); err != nil {
+			t.Errorf("node_modules is missing %s: %v", dep, err)
+		}
+	}
+}
+
+// npmFixture writes a project with a production and a dev dependency, both local file: packages so
+// they install without a registry, and returns its directory and a function running npm in it
+func npmFixture(t *testing.T) (string, func(args ...string)) {
+	t.Helper()
+
+	if _, err := exec.LookPath("npm"); err != nil {
+		t.Skip("npm is not available")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"package.json":          `{"name": "app", "version": "1.0.0", "dependencies": {"prod-dep": "file:./prod-dep"}, "devDependencies": {"dev-dep": "file:./dev-dep"}}`,
+		"prod-dep/package.json": `{"name": "prod-dep", "version": "1.0.0"}`,
+		"dev-dep/package.json":  `{"name": "dev-dep", "version": "1.0.0"}`,
+	}
+
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	npm := func(args ...string) {
+		t.Helper()
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "npm_config_offline=true", "npm_config_audit=false", "npm_config_fund=false")
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	npm("npm", "install", "--package-lock-only")
+
+	return dir, npm
+}
+
+func TestTrustCACommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	tests := []struct {
+		name       string
+		updateExit int
+		wantBundle string
+	}{
+		{"updates the trust store", 0, "system\n"},
+		{"appends without update-ca-certificates", 127, "system\ncustom\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cert := filepath.Join(dir, "custom-ca.crt")
+			bundle := filepath.Join(dir, "ca-certificates.crt")
+
+			if err := os.WriteFile(cert, []byte("custom\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(bundle, []byte("system\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// The stub stands in for update-ca-certificates, exiting 127 as if it weren't installed
+			stub := fmt.Sprintf("exit %d\n", tt.updateExit)
+			if err := os.WriteFile(filepath.Join(dir, "update-ca-certificates"), []byte(stub), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("sh", "-c", trustCACommand(cert, bundle))
+			cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("trust CA command error = %v\n%s", err, out)
+			}
+
+			got, err := os.ReadFile(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.wantBundle {
+				t.Errorf("CA bundle = %q, want %q", got, tt.wantBundle)
+			}
+		})
+	}
+}
+
+func TestInstallStepsNoCache(t *testing.T) {
+	cacheResolved := false
+	cache := func() (string, string) {
+		cacheResolved = true
+		return "/root/.npm", "npm-cache"
+	}
+
+	m := &NodeCi{PackageManager: NPM}
+
+	steps := m.installSteps(installOpts{}, true, cache)
+	if i := slices.IndexFunc(steps, isStep(mountCacheStep)); i == -1 || steps[i].path != "/root/.npm" || steps[i].value != "npm-cache" {
+		t.Errorf("installSteps() = %+v, want the npm cache mounted", steps)
+	}
+
+	cacheResolved = false
+
+	steps = m.installSteps(installOpts{noCache: true, cacheBust: "2026-10-14"}, true, cache)
+	if slices.ContainsFunc(steps, isStep(mountCacheStep)) || cacheResolved {
+		t.Errorf("installSteps() with noCache = %+v, want no cache mount", steps)
+	}
+
+	if i := slices.IndexFunc(steps, isStep(envStep)); i == -1 || steps[i].path != "CACHE_BUSTER" || steps[i].value != "2026-10-14" {
+		t.Errorf("installSteps() with cacheBust = %+v, want CACHE_BUSTER set", steps)
+	}
+
+	if i, install := slices.IndexFunc(steps, isStep(envStep)), slices.IndexFunc(steps, isStep(execStep)); i > install {
+		t.Errorf("installSteps() sets CACHE_BUSTER after the install, at step %d of %+v", i, steps)
+	}
+}
+
+// isStep returns a function matching install steps of the kind
+func isStep(kind installStepKind) func(installStep) bool {
+	return func(step installStep) bool {
+		return step.kind == kind
+	}
+}
+
+func TestContentCacheVolume(t *testing.T) {
+	digest := "sha256:3f7a9c2e1b4d5f60718293a4b5c6d7e8f9012345678abcdef0123456789abcd"
+
+	tests := []struct {
+		manager PackageManager
+		want    string
+	}{
+		{NPM, "npm-cache-3f7a9c2e1b4d"},
+		{Yarn, "yarn-cache-3f7a9c2e1b4d"},
+		{PNPM, "pnpm-cache-3f7a9c2e1b4d"},
+		{Bun, "bun-cache-3f7a9c2e1b4d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.manager), func(t *testing.T) {
+			m := &NodeCi{PackageManager: tt.manager}
+
+			// Without content keys the shared volume is used and the lockfile isn't read
+			_, shared := m.getPackageManagerCache(context.Background())
+			if want := strings.TrimSuffix(tt.want, "-3f7a9c2e1b4d"); shared != want {
+				t.Errorf("getPackageManagerCache() volume = %q, want %q", shared, want)
+			}
+
+			if got := contentCacheVolume(shared, digest); got != tt.want {
+				t.Errorf("contentCacheVolume() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := shortDigest("abc123"); got != "abc123" {
+		t.Errorf("shortDigest() without an algorithm = %q, want %q", got, "abc123")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *NodeCi
+		want ModuleInfo
+	}{
+		{
+			"default image",
+			&NodeCi{NodeVersion: "22", PackageManager: PNPM},
+			ModuleInfo{Module: "node-ci", NodeVersion: "22", PackageManager: PNPM, BaseImage: "node:22-alpine"},
+		},
+		{
+			"custom image",
+			&NodeCi{NodeVersion: "20", PackageManager: NPM, BaseImage: "registry.example.com/node:20-bookworm"},
+			ModuleInfo{Module: "node-ci", NodeVersion: "20", PackageManager: NPM, BaseImage: "registry.example.com/node:20-bookworm"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.Info(context.Background()); *got != tt.want {
+				t.Errorf("Info() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackageManagerFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		declared  string
+		lockfiles []string
+		want      PackageManager
+	}{
+		{"declared pnpm", "pnpm@9.1.0", nil, PNPM},
+		{"declared yarn with a hash", "yarn@4.1.0+sha512.abc", nil, Yarn},
+		{"declared takes precedence over the lockfile", "bun@1.1.0", []string{"package-lock.json"}, Bun},
+		{"unknown declared manager", "deno@2.0.0", []string{"yarn.lock"}, Yarn},
+		{"pnpm lockfile", "", []string{"pnpm-lock.yaml"}, PNPM},
+		{"yarn lockfile", "", []string{"yarn.lock"}, Yarn},
+		{"bun lockfile", "", []string{"bun.lockb"}, Bun},
+		{"npm lockfile", "", []string{"package-lock.json"}, NPM},
+		{"pnpm lockfile wins over a stale npm one", "", []string{"package-lock.json", "pnpm-lock.yaml"}, PNPM},
+		{"nothing to detect", "", nil, NPM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exists := func(name string) bool {
+				return slices.Contains(tt.lockfiles, name)
+			}
+
+			if got := packageManagerFor(tt.declared, exists); got != tt.want {
+				t.Errorf("packageManagerFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallStepsNpmrc(t *testing.T) {
+	cache := func() (string, string) { return "/root/.npm", "npm-cache" }
+
+	for _, workspace := range []string{"", "packages/web"} {
+		t.Run("workspace "+workspace, func(t *testing.T) {
+			m := &NodeCi{PackageManager: NPM, Npmrc: &dagger.Secret{}, Workspace: workspace}
+			steps := m.installSteps(installOpts{}, true, cache)
+
+			// Registry settings and auth in the .npmrc must apply to the install itself
+			npmrc := slices.IndexFunc(steps, isStep(mountNpmrcStep))
+			install := slices.IndexFunc(steps, isStep(execStep))
+
+			if npmrc == -1 || steps[npmrc].path != "/app/.npmrc" {
+				t.Fatalf("installSteps() = %+v, want the .npmrc mounted at /app/.npmrc", steps)
+			}
+
+			if npmrc > install {
+				t.Errorf("installSteps() mounts the .npmrc at step %d, after the install at step %d", npmrc, install)
+			}
+		})
+	}
+
+	if steps := (&NodeCi{PackageManager: NPM}).installSteps(installOpts{}, true, cache); slices.ContainsFunc(steps, isStep(mountNpmrcStep)) {
+		t.Errorf("installSteps() without an .npmrc = %+v, want no .npmrc mount", steps)
+	}
+}
+
+func TestExecReturnsFullStdout(t *testing.T) {
+	if _, err := exec.LookPath("npm"); err != nil {
+		t.Skip("npm is not available")
+	}
+
+	// The script writes far more than a pipe buffer, as a long build's log would
+	dir := t.TempDir()
+	manifest := `{"name": "app", "version": "1.0.0", "scripts": {"build": "node -e \"for (let i = 0; i < 20000; i++) console.log('line ' + i)\""}}`
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := (&NodeCi{PackageManager: NPM}).runArgs("build", []string{"--silent"})
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s failed: %v", strings.Join(args, " "), err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != 20000 || lines[0] != "line 0" || lines[len(lines)-1] != "line 19999" {
+		t.Errorf("%s returned %d lines ending %q, want all 20000", strings.Join(args, " "), len(lines), lines[len(lines)-1])
+	}
+}
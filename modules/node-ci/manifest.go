@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"dagger/node-ci/internal/dagger"
+)
+
+// ValidateManifest checks package.json declares every required field, and optionally validates it
+// against a JSON schema. With a workspace set, the workspace package's package.json is checked
+func (m *NodeCi) ValidateManifest(
+	ctx context.Context,
+	// Top-level fields that must be present and non-empty (e.g. license, repository, files)
+	requiredFields []string,
+	// A JSON schema to validate package.json against
+	// +optional
+	schema *dagger.File,
+) error {
+	path := filepath.Join(m.Workspace, "package.json")
+
+	contents, err := m.Source.File(path).Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var manifest map[string]any
+	if err := json.Unmarshal([]byte(contents), &manifest); err != nil {
+		return fmt.Errorf("package.json is not valid JSON: %w", err)
+	}
+
+	if missing := missingFields(manifest, requiredFields); len(missing) > 0 {
+		return fmt.Errorf("package.json is missing required fields: %s", strings.Join(missing, ", "))
+	}
+
+	if schema == nil {
+		return nil
+	}
+
+	_, err = m.Base().
+		WithFile("/tmp/schema.json", schema).
+		WithFile("/tmp/package.json", m.Source.File(path)).
+		WithExec([]string{"npx", "--yes", "ajv-cli@5", "validate", "-s", "/tmp/schema.json", "-d", "/tmp/package.json"}).
+		Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("package.json does not match schema: %w", err)
+	}
+
+	return nil
+}
+
+// missingFields returns the required fields that are absent, null or empty in the manifest
+func missingFields(manifest map[string]any, required []string) []string {
+	var missing []string
+
+	for _, field := range required {
+		switch v := manifest[field].(type) {
+		case nil:
+			missing = append(missing, field)
+		case string:
+			if strings.TrimSpace(v) == "" {
+				missing = append(missing, field)
+			}
+		case []any:
+			if len(v) == 0 {
+				missing = append(missing, field)
+			}
+		case map[string]any:
+			if len(v) == 0 {
+				missing = append(missing, field)
+			}
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestMissingFields(t *testing.T) {
+	contents := `{
+  "name": "app",
+  "license": "MIT",
+  "description": "  ",
+  "files": [],
+  "repository": {},
+  "author": null,
+  "private": false,
+  "keywords": ["ci"]
+}`
+
+	var manifest map[string]any
+	if err := json.Unmarshal([]byte(contents), &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	required := []string{"name", "license", "description", "files", "repository", "author", "private", "keywords", "version"}
+	want := []string{"description", "files", "repository", "author", "version"}
+
+	if got := missingFields(manifest, required); !slices.Equal(got, want) {
+		t.Errorf("missingFields() = %q, want %q", got, want)
+	}
+}
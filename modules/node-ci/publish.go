@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dagger/node-ci/internal/dagger"
+)
+
+// Publish builds the package if it has a build script and publishes it to the registry with the
+// given dist-tag, returning the published version. Fails if the version is already published
+func (m *NodeCi) Publish(
+	ctx context.Context,
+	// Registry auth token, exposed to the package manager only through .npmrc
+	token *dagger.Secret,
+	// Dist-tag to publish under
+	// +default="latest"
+	tag string,
+	// Access level for scoped packages (public or restricted), defaults to the registry's
+	// +optional
+	access string,
+	// Registry to publish to
+	// +default="https://registry.npmjs.org/"
+	registry string,
+) (string, error) {
+	switch access {
+	case "", "public", "restricted":
+	default:
+		return "", fmt.Errorf("invalid access level: %s", access)
+	}
+
+	manifestPath := filepath.Join(m.Workspace, "package.json")
+
+	contents, err := m.Source.File(manifestPath).Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", manifestPath, err)
+	}
+
+	var manifest struct {
+		Name    string            `json:"name"`
+		Version string            `json:"version"`
+		Scripts map[string]string `json:"scripts"`
+	}
+
+	if err := json.Unmarshal([]byte(contents), &manifest); err != nil {
+		return "", fmt.Errorf("%s is not valid JSON: %w", manifestPath, err)
+	}
+
+	if manifest.Name == "" || manifest.Version == "" {
+		return "", fmt.Errorf("%s must declare a name and version to publish", manifestPath)
+	}
+
+	npmrc, err := npmrcAuth(registry)
+	if err != nil {
+		return "", err
+	}
+
+	// npm expands ${NPM_TOKEN} when reading .npmrc, so the token itself is never written to a file.
+	// The registry is external state, so the cache is busted to always check and publish for real
+	ctr := m.getContainer(ctx).
+		WithSecretVariable("NPM_TOKEN", token).
+		WithNewFile("/root/.npmrc", npmrc).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	// npm view exits non-zero for an unpublished version, so only output means it already exists
+	existing, _ := ctr.
+		WithExec([]string{"npm", "view", manifest.Name + "@" + manifest.Version, "version", "--registry", registry}).
+		Stdout(ctx)
+	if strings.TrimSpace(existing) != "" {
+		return "", fmt.Errorf("%s@%s is already published to %s", manifest.Name, manifest.Version, registry)
+	}
+
+	if _, ok := manifest.Scripts["build"]; ok {
+		ctr = ctr.WithExec(m.runArgs("build", nil))
+	}
+
+	_, err = ctr.
+		WithExec(m.publishArgs(tag, access, registry)).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to publish %s@%s: %w", manifest.Name, manifest.Version, err)
+	}
+
+	return manifest.Version, nil
+}
+
+// publishArgs returns the package manager's publish command. Yarn classic's publish prompts for a
+// version, so npm is used for it instead
+func (m *NodeCi) publishArgs(tag string, access string, registry string) []string {
+	var args []string
+
+	switch m.PackageManager {
+	case PNPM:
+		// pnpm rewrites workspace: dependency ranges, and refuses to publish outside a clean git checkout
+		args = []string{"pnpm", "publish", "--no-git-checks"}
+	case Bun:
+		args = []string{"bun", "publish"}
+	default:
+		args = []string{"npm", "publish"}
+	}
+
+	args = append(args, "--tag", tag, "--registry", registry)
+	if access != "" {
+		args = append(args, "--access", access)
+	}
+
+	return args
+}
+
+// npmrcAuth returns an .npmrc authenticating to the registry with the NPM_TOKEN environment variable
+func npmrcAuth(registry string) (string, error) {
+	u, err := url.Parse(registry)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid registry URL: %s", registry)
+	}
+
+	path := strings.TrimSuffix(u.Path, "/") + "/"
+	return fmt.Sprintf("//%s%s:_authToken=${NPM_TOKEN}\n", u.Host, path), nil
+}
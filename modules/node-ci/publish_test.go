@@ -0,0 +1,50 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPublishArgs(t *testing.T) {
+	tests := []struct {
+		manager PackageManager
+		access  string
+		want    []string
+	}{
+		{NPM, "", []string{"npm", "publish", "--tag", "next", "--registry", "https://registry.npmjs.org/"}},
+		{Yarn, "public", []string{"npm", "publish", "--tag", "next", "--registry", "https://registry.npmjs.org/", "--access", "public"}},
+		{PNPM, "", []string{"pnpm", "publish", "--no-git-checks", "--tag", "next", "--registry", "https://registry.npmjs.org/"}},
+		{Bun, "restricted", []string{"bun", "publish", "--tag", "next", "--registry", "https://registry.npmjs.org/", "--access", "restricted"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.manager), func(t *testing.T) {
+			m := &NodeCi{PackageManager: tt.manager}
+			if got := m.publishArgs("next", tt.access, "https://registry.npmjs.org/"); !slices.Equal(got, tt.want) {
+				t.Errorf("publishArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpmrcAuth(t *testing.T) {
+	tests := []struct {
+		registry string
+		want     string
+		wantErr  bool
+	}{
+		{"https://registry.npmjs.org/", "//registry.npmjs.org/:_authToken=${NPM_TOKEN}\n", false},
+		{"https://npm.pkg.github.com", "//npm.pkg.github.com/:_authToken=${NPM_TOKEN}\n", false},
+		{"https://nexus.example.com/repository/npm/", "//nexus.example.com/repository/npm/:_authToken=${NPM_TOKEN}\n", false},
+		{"registry.npmjs.org", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			got, err := npmrcAuth(tt.registry)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("npmrcAuth() = %q, %v, want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"dagger/node-ci/internal/dagger"
+)
+
+// Service runs a package.json script as a service listening on the given port, e.g. the built app
+// for e2e tests
+func (m *NodeCi) Service(
+	ctx context.Context,
+	// Port the app listens on
+	// +default=3000
+	port int,
+	// Script to run
+	// +default="start"
+	script string,
+) *dagger.Service {
+	return m.getContainer(ctx).
+		WithExposedPort(port).
+		AsService(dagger.ContainerAsServiceOpts{Args: m.runArgs(script, nil)})
+}
+
+// WaitForPort starts the app as a service and returns it once the port accepts connections, failing
+// if it isn't listening within the timeout
+func (m *NodeCi) WaitForPort(
+	ctx context.Context,
+	// Port the app listens on
+	// +default=3000
+	port int,
+	// Seconds to wait for the port to open
+	// +default=60
+	timeout int,
+	// Script to run
+	// +default="start"
+	script string,
+) (*dagger.Service, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout must be positive")
+	}
+
+	svc, err := m.Service(ctx, port, script).Start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start service: %w", err)
+	}
+
+	_, err = dag.Container().
+		From("alpine:latest").
+		WithServiceBinding("app", svc).
+		WithExec([]string{"sh", "-c", portProbeScript("app", port, timeout)}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("service did not start listening on port %d: %w", port, err)
+	}
+
+	return svc, nil
+}
+
+// portProbeScript returns a shell script that checks the port with capped exponential backoff,
+// failing once the timeout in seconds has elapsed
+func portProbeScript(host string, port int, timeout int) string {
+	return fmt.Sprintf(`start=$(date +%%s)
+delay=1
+until nc -z %[1]s %[2]d; do
+  elapsed=$(( $(date +%%s) - start ))
+  if [ "$elapsed" -ge %[3]d ]; then
+    echo "Timed out waiting for %[1]s:%[2]d to accept connections after ${elapsed}s (timeout %[3]ds)" >&2
+    exit 1
+  fi
+  echo "Waiting for %[1]s:%[2]d... (${elapsed}s elapsed)"
+  remaining=$(( %[3]d - elapsed ))
+  if [ "$delay" -gt "$remaining" ]; then delay=$remaining; fi
+  sleep "$delay"
+  delay=$(( delay * 2 ))
+  if [ "$delay" -gt 8 ]; then delay=8; fi
+done`, host, port, timeout)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPortProbeScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	tests := []struct {
+		name         string
+		failures     int
+		timeout      int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"already listening", 0, 10, false, 1},
+		{"waits for the port to open", 1, 10, false, 2},
+		{"times out", 100, 1, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			counter := filepath.Join(dir, "attempts")
+			probes := filepath.Join(dir, "probes")
+
+			// The stub nc records what it probes and refuses the given number of connections
+			script := fmt.Sprintf(`n=$(cat %[1]s 2>/dev/null || echo 0)
+echo $((n + 1)) > %[1]s
+echo "$@" >> %[2]s
+[ "$n" -ge %[3]d ]
+`, counter, probes, tt.failures)
+
+			if err := os.WriteFile(filepath.Join(dir, "nc"), []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("sh", "-c", portProbeScript("app", 3000, tt.timeout))
+			cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			out, err := cmd.CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("port probe script error = %v, want error %t\n%s", err, tt.wantErr, out)
+			}
+
+			if tt.wantErr && !strings.Contains(string(out), "Timed out waiting for app:3000") {
+				t.Errorf("port probe script output = %q, want a timeout message", out)
+			}
+
+			attempts, err := os.ReadFile(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.TrimSpace(string(attempts)); got != fmt.Sprint(tt.wantAttempts) {
+				t.Errorf("port probe script probed %s times, want %d", got, tt.wantAttempts)
+			}
+
+			logged, err := os.ReadFile(probes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if first, _, _ := strings.Cut(string(logged), "\n"); first != "-z app 3000" {
+				t.Errorf("port probe script ran nc %q, want %q", first, "-z app 3000")
+			}
+		})
+	}
+}
@@ -3,12 +3,35 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"dagger/python-ci/internal/dagger"
 )
 
+const (
+	caCertPath     = "/usr/local/share/ca-certificates/custom-ca.crt"
+	systemCABundle = "/etc/ssl/certs/ca-certificates.crt"
+	// pytestNoTests is the exit code pytest returns when no tests were collected
+	pytestNoTests = 5
+)
+
+// errorCodePattern matches a flake8 error code or code prefix such as E, W6 or F401
+var errorCodePattern = regexp.MustCompile(`^[A-Z]+[0-9]*$`)
+
 // PythonCi module for Python CI tasks
 type PythonCi struct {
+	// +private
+	CaCert *dagger.File
+	// +private
+	ExtraIndexURLs []string
+	// +private
+	IndexCredentials *dagger.Secret
+	// +private
+	IndexURL string
 	// +private
 	PythonVersion string
 	// +private
@@ -22,21 +45,107 @@ func New(
 	// The Python version to use
 	// +default="3.14"
 	pythonVersion string,
+	// The base URL of the Python package index, replacing PyPI
+	// +optional
+	indexUrl string,
+	// Additional package index URLs to search alongside the main index
+	// +optional
+	extraIndexUrls []string,
+	// A netrc file providing credentials for the package indexes
+	// +optional
+	indexCredentials *dagger.Secret,
+	// A custom CA certificate in PEM format to trust, e.g. for a TLS-inspecting proxy
+	// +optional
+	caCert *dagger.File,
 ) *PythonCi {
 	return &PythonCi{
-		PythonVersion: pythonVersion,
-		Source:        source,
+		CaCert:           caCert,
+		ExtraIndexURLs:   extraIndexUrls,
+		IndexCredentials: indexCredentials,
+		IndexURL:         indexUrl,
+		PythonVersion:    pythonVersion,
+		Source:           source,
 	}
 }
 
-// Base returns the base Python container
+// Base returns the base Python container, configured with any custom package indexes
 func (m *PythonCi) Base() *dagger.Container {
-	return dag.Container().
+	ctr := dag.Container().
 		From("python:" + m.PythonVersion + "-slim")
+
+	// pip ships its own CA bundle, so point it at the updated system store
+	if m.CaCert != nil {
+		ctr = ctr.
+			WithFile(caCertPath, m.CaCert).
+			WithExec([]string{"sh", "-c", trustCACommand(caCertPath, systemCABundle)}).
+			WithEnvVariable("PIP_CERT", systemCABundle)
+	}
+
+	for _, env := range m.indexEnv() {
+		name, value, _ := strings.Cut(env, "=")
+		ctr = ctr.WithEnvVariable(name, value)
+	}
+
+	// Mounted rather than copied so credentials never end up in a cached layer
+	if m.IndexCredentials != nil {
+		ctr = ctr.WithMountedSecret("/root/.netrc", m.IndexCredentials)
+	}
+
+	return ctr
+}
+
+// trustCACommand returns the shell command adding the certificate to the system trust store,
+// appending it to the bundle directly on images without update-ca-certificates
+func trustCACommand(cert string, bundle string) string {
+	return "update-ca-certificates 2>/dev/null || cat " + cert + " >> " + bundle
+}
+
+// indexEnv returns the pip environment variables in KEY=VALUE format selecting the package indexes
+func (m *PythonCi) indexEnv() []string {
+	var env []string
+
+	if m.IndexURL != "" {
+		env = append(env, "PIP_INDEX_URL="+m.IndexURL)
+	}
+
+	if len(m.ExtraIndexURLs) > 0 {
+		env = append(env, "PIP_EXTRA_INDEX_URL="+strings.Join(m.ExtraIndexURLs, " "))
+	}
+
+	return env
+}
+
+// WithOverlay merges a directory over the source, with overlay files taking precedence, e.g. to test
+// a patch without committing it
+func (m *PythonCi) WithOverlay(
+	// Files to overlay onto the source directory
+	overlay *dagger.Directory,
+) *PythonCi {
+	m.Source = m.Source.WithDirectory(".", overlay)
+	return m
 }
 
 // Lint runs flake8 linting on the Python source code
-func (m *PythonCi) Lint(ctx context.Context) (string, error) {
+func (m *PythonCi) Lint(
+	ctx context.Context,
+	// Glob patterns to exclude from linting, in addition to flake8's defaults
+	// +optional
+	exclude []string,
+	// Paths relative to the source directory to lint instead of the whole tree
+	// +optional
+	paths []string,
+	// Error codes or prefixes to report, replacing flake8's default selection (e.g. E, W, F401)
+	// +optional
+	selectCodes []string,
+	// Error codes or prefixes to ignore, in addition to flake8's default ignore list
+	// +optional
+	ignoreCodes []string,
+) (string, error) {
+	args, err := lintArgs(exclude, paths, selectCodes, ignoreCodes)
+	if err != nil {
+		return "", err
+	}
+
 	return m.Base().
 		WithMountedCache(
 			"/root/.cache/pip",
@@ -46,6 +155,207 @@ func (m *PythonCi) Lint(ctx context.Context) (string, error) {
 		WithExec([]string{"pip", "install", "flake8==7.0.0"}).
 		WithDirectory("/src", m.Source).
 		WithWorkdir("/src").
-		WithExec([]string{"flake8", "."}).
+		WithExec(args).
+		Stdout(ctx)
+}
+
+// Test installs the project requirements and runs pytest, optionally distributing tests across
+// workers with pytest-xdist. Tests with the excluded marker then run serially in a second pass
+func (m *PythonCi) Test(
+	ctx context.Context,
+	// Number of pytest-xdist workers, 0 runs serially and -1 uses one worker per CPU
+	// +optional
+	parallel int,
+	// Marker of tests that aren't parallel-safe, run serially after the parallel pass (e.g. serial)
+	// +optional
+	excludeMarker string,
+) (string, error) {
+	ctr := m.Base().
+		WithMountedCache(
+			"/root/.cache/pip",
+			dag.CacheVolume("pip-cache"),
+		).
+		WithExec([]string{"pip", "install", "--upgrade", "pip"}).
+		WithExec(testPackages(parallel)).
+		WithDirectory("/src", m.Source).
+		WithWorkdir("/src")
+
+	requirements, err := m.Source.Glob(ctx, "requirements.txt")
+	if err != nil {
+		return "", fmt.Errorf("failed to check for requirements.txt: %w", err)
+	}
+
+	if len(requirements) > 0 {
+		ctr = ctr.WithExec([]string{"pip", "install", "-r", "requirements.txt"})
+	}
+
+	out, err := ctr.
+		WithExec(testArgs(parallel, excludeMarker)).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	serialArgs := serialTestArgs(parallel, excludeMarker)
+	if serialArgs == nil {
+		return out, nil
+	}
+
+	serial := ctr.WithExec(serialArgs, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := serial.ExitCode(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run serial tests: %w", err)
+	}
+
+	serialOut, err := serial.CombinedOutput(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read serial test output: %w", err)
+	}
+
+	return serialTestResult(out, serialOut, exitCode)
+}
+
+// serialTestArgs returns the pytest command running the tests excluded from the parallel pass, or
+// nil when every test already ran
+func serialTestArgs(parallel int, excludeMarker string) []string {
+	if parallel == 0 || excludeMarker == "" {
+		return nil
+	}
+
+	return []string{"pytest", "-m", excludeMarker}
+}
+
+// serialTestResult combines the output of both passes. Pytest exits non-zero when no tests have the
+// marker, which isn't a failure
+func serialTestResult(parallelOut string, serialOut string, exitCode int) (string, error) {
+	if exitCode != 0 && exitCode != pytestNoTests {
+		return "", fmt.Errorf("serial tests failed:\n%s", serialOut)
+	}
+
+	return parallelOut + serialOut, nil
+}
+
+// testPackages returns the pip command installing pytest, with pytest-xdist when running in parallel
+func testPackages(parallel int) []string {
+	packages := []string{"pip", "install", "pytest"}
+	if parallel != 0 {
+		packages = append(packages, "pytest-xdist")
+	}
+
+	return packages
+}
+
+// testArgs returns the pytest command for the given parallelism
+func testArgs(parallel int, excludeMarker string) []string {
+	args := []string{"pytest"}
+
+	switch {
+	case parallel < 0:
+		args = append(args, "-n", "auto")
+	case parallel > 0:
+		args = append(args, "-n", strconv.Itoa(parallel))
+	}
+
+	if parallel != 0 && excludeMarker != "" {
+		args = append(args, "-m", "not "+excludeMarker)
+	}
+
+	return args
+}
+
+// LintDiff runs flake8 only on the Python files changed relative to the base ref. The source
+// directory must include the .git directory
+func (m *PythonCi) LintDiff(
+	ctx context.Context,
+	// The ref to diff against (e.g. origin/main)
+	baseRef string,
+) (string, error) {
+	files, err := m.changedFiles(ctx, baseRef)
+	if err != nil {
+		return "", err
+	}
+
+	if len(files) == 0 {
+		return "No changed Python files to lint", nil
+	}
+
+	return m.Lint(ctx, nil, files, nil, nil)
+}
+
+// changedFiles returns the Python files that differ from the base ref, excluding deleted files
+func (m *PythonCi) changedFiles(ctx context.Context, baseRef string) ([]string, error) {
+	out, err := dag.Container().
+		From("alpine/git:latest").
+		WithMountedDirectory("/src", m.Source).
+		WithWorkdir("/src").
+		WithExec(changedFilesArgs(baseRef)).
 		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed files against %s: %w", baseRef, err)
+	}
+
+	return parseChangedFiles(out), nil
+}
+
+// changedFilesArgs returns the git command listing the Python files changed since the base ref,
+// NUL-terminated so paths containing spaces or newlines survive
+func changedFilesArgs(baseRef string) []string {
+	return []string{"git", "-c", "safe.directory=*", "diff", "--name-only", "-z", "--diff-filter=d", baseRef, "--", "*.py"}
+}
+
+// parseChangedFiles splits the NUL-terminated output of git diff -z into paths
+func parseChangedFiles(out string) []string {
+	files := make([]string, 0)
+	for _, file := range strings.Split(out, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// lintArgs returns the flake8 command for the given exclusions, paths and error code selection
+func lintArgs(exclude []string, paths []string, selectCodes []string, ignoreCodes []string) ([]string, error) {
+	args := []string{"flake8"}
+
+	for _, codes := range [][]string{selectCodes, ignoreCodes} {
+		for _, code := range codes {
+			if !errorCodePattern.MatchString(code) {
+				return nil, fmt.Errorf("invalid error code %q", code)
+			}
+		}
+	}
+
+	if len(selectCodes) > 0 {
+		args = append(args, "--select="+strings.Join(selectCodes, ","))
+	}
+
+	if len(ignoreCodes) > 0 {
+		args = append(args, "--extend-ignore="+strings.Join(ignoreCodes, ","))
+	}
+
+	if len(exclude) > 0 {
+		for _, pattern := range exclude {
+			if pattern == "" || strings.Contains(pattern, ",") {
+				return nil, fmt.Errorf("invalid exclude pattern %q", pattern)
+			}
+		}
+
+		args = append(args, "--extend-exclude="+strings.Join(exclude, ","))
+	}
+
+	if len(paths) == 0 {
+		return append(args, "."), nil
+	}
+
+	for _, path := range paths {
+		clean := filepath.Clean(path)
+		if path == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("invalid lint path %q: must be relative to the source directory", path)
+		}
+	}
+
+	return append(args, paths...), nil
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIndexEnv(t *testing.T) {
+	tests := []struct {
+		name           string
+		indexURL       string
+		extraIndexURLs []string
+		want           []string
+	}{
+		{"pypi", "", nil, nil},
+		{"index", "https://pypi.example.com/simple", nil, []string{"PIP_INDEX_URL=https://pypi.example.com/simple"}},
+		{
+			"index and extra indexes",
+			"https://pypi.example.com/simple",
+			[]string{"https://a.example.com/simple", "https://b.example.com/simple"},
+			[]string{
+				"PIP_INDEX_URL=https://pypi.example.com/simple",
+				"PIP_EXTRA_INDEX_URL=https://a.example.com/simple https://b.example.com/simple",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(nil, "3.14", tt.indexURL, tt.extraIndexURLs, nil, nil)
+			if got := m.indexEnv(); !slices.Equal(got, tt.want) {
+				t.Errorf("indexEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		paths   []string
+		want    []string
+	}{
+		{"defaults", nil, nil, []string{"flake8", "."}},
+		{"exclude", []string{"migrations", "*.pyi"}, nil, []string{"flake8", "--extend-exclude=migrations,*.pyi", "."}},
+		{"paths", nil, []string{"src", "tests/unit"}, []string{"flake8", "src", "tests/unit"}},
+		{"exclude and paths", []string{"build"}, []string{"src"}, []string{"flake8", "--extend-exclude=build", "src"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lintArgs(tt.exclude, tt.paths, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lintArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintArgsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		paths   []string
+	}{
+		{"empty exclude", []string{""}, nil},
+		{"exclude with separator", []string{"a,b"}, nil},
+		{"absolute path", nil, []string{"/etc"}},
+		{"path outside source", nil, []string{"../other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := lintArgs(tt.exclude, tt.paths, nil, nil); err == nil {
+				t.Error("lintArgs() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestLintArgsErrorCodes(t *testing.T) {
+	got, err := lintArgs(nil, nil, []string{"E", "W6"}, []string{"E501", "W503"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"flake8", "--select=E,W6", "--extend-ignore=E501,W503", "."}
+	if !slices.Equal(got, want) {
+		t.Errorf("lintArgs() = %q, want %q", got, want)
+	}
+
+	for _, code := range []string{"e501", "E501,W503", ""} {
+		if _, err := lintArgs(nil, nil, []string{code}, nil); err == nil {
+			t.Errorf("lintArgs() with select code %q succeeded, want an error", code)
+		}
+	}
+}
+
+func TestTestArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		parallel      int
+		excludeMarker string
+		wantPackages  []string
+		wantArgs      []string
+		wantSerial    []string
+	}{
+		{"serial", 0, "", []string{"pip", "install", "pytest"}, []string{"pytest"}, nil},
+		{"serial ignores the marker", 0, "serial", []string{"pip", "install", "pytest"}, []string{"pytest"}, nil},
+		{"fixed workers", 4, "", []string{"pip", "install", "pytest", "pytest-xdist"}, []string{"pytest", "-n", "4"}, nil},
+		{"worker per CPU", -1, "", []string{"pip", "install", "pytest", "pytest-xdist"}, []string{"pytest", "-n", "auto"}, nil},
+		{"parallel excludes the marker", 2, "serial", []string{"pip", "install", "pytest", "pytest-xdist"}, []string{"pytest", "-n", "2", "-m", "not serial"}, []string{"pytest", "-m", "serial"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testPackages(tt.parallel); !slices.Equal(got, tt.wantPackages) {
+				t.Errorf("testPackages() = %q, want %q", got, tt.wantPackages)
+			}
+
+			if got := testArgs(tt.parallel, tt.excludeMarker); !slices.Equal(got, tt.wantArgs) {
+				t.Errorf("testArgs() = %q, want %q", got, tt.wantArgs)
+			}
+
+			if got := serialTestArgs(tt.parallel, tt.excludeMarker); !slices.Equal(got, tt.wantSerial) {
+				t.Errorf("serialTestArgs() = %q, want %q", got, tt.wantSerial)
+			}
+		})
+	}
+}
+
+func TestSerialTestResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		exitCode int
+		want     string
+		wantErr  bool
+	}{
+		{"passed", 0, "parallel\nserial\n", false},
+		{"no marked tests", 5, "parallel\nserial\n", false},
+		{"failed", 1, "", true},
+		{"interrupted", 2, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serialTestResult("parallel\n", "serial\n", tt.exitCode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serialTestResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("serialTestResult() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustCACommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	tests := []struct {
+		name       string
+		updateExit int
+		wantBundle string
+	}{
+		{"updates the trust store", 0, "system\n"},
+		{"appends without update-ca-certificates", 127, "system\ncustom\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cert := filepath.Join(dir, "custom-ca.crt")
+			bundle := filepath.Join(dir, "ca-certificates.crt")
+
+			if err := os.WriteFile(cert, []byte("custom\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(bundle, []byte("system\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// The stub stands in for update-ca-certificates, exiting 127 as if it weren't installed
+			stub := fmt.Sprintf("exit %d\n", tt.updateExit)
+			if err := os.WriteFile(filepath.Join(dir, "update-ca-certificates"), []byte(stub), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("sh", "-c", trustCACommand(cert, bundle))
+			cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("trust CA command error = %v\n%s", err, out)
+			}
+
+			got, err := os.ReadFile(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.wantBundle {
+				t.Errorf("CA bundle = %q, want %q", got, tt.wantBundle)
+			}
+		})
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir := t.TempDir()
+
+	git := func(args ...string) string {
+		t.Helper()
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s failed: %v", strings.Join(args, " "), err)
+		}
+
+		return string(out)
+	}
+
+	write := func(name string, contents string) {
+		t.Helper()
+
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("git", "init", "-q", "-b", "main")
+	git("git", "config", "user.email", "ci@example.com")
+	git("git", "config", "user.name", "CI")
+
+	write("app.py", "x = 1\n")
+	write("removed.py", "y = 2\n")
+	write("unchanged.py", "z = 3\n")
+	git("git", "add", "-A")
+	git("git", "commit", "-q", "-m", "initial")
+	git("git", "checkout", "-q", "-b", "feature")
+
+	write("app.py", "x = 2\n")
+	write("my module.py", "a = 1\n")
+	write("pkg/handlers.py", "b = 1\n")
+	write("README.md", "docs\n")
+	if err := os.Remove(filepath.Join(dir, "removed.py")); err != nil {
+		t.Fatal(err)
+	}
+
+	git("git", "add", "-A")
+	git("git", "commit", "-q", "-m", "change")
+
+	got := parseChangedFiles(git(changedFilesArgs("main")...))
+	want := []string{"app.py", "my module.py", "pkg/handlers.py"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("changed files = %q, want %q", got, want)
+	}
+
+	if got := parseChangedFiles(""); len(got) != 0 {
+		t.Errorf("parseChangedFiles() with no changes = %q, want none", got)
+	}
+}